@@ -9,6 +9,7 @@ import (
 //without loading the full data.
 //It can be backed by os.File, as it is a subset of os.File, except Size.
 //All error reporting are turned off, as none are expected (panic otherwise).
+//BlobE is the same with errors reported, and MustBlob turns it to a Blob.
 type Blob interface {
 	//length in bytes for this block
 	Size() int64
@@ -29,6 +30,66 @@ type Closer interface {
 	Close()
 }
 
+//BlobE is like Blob, but reports I/O errors instead of panicking, so a bad
+//sector of a disk only fails the blob on it. Out of range access is still a
+//bug that panics.
+type BlobE interface {
+	Size() int64
+	ReadAt(b []byte, off int64) error
+	WriteAt(b []byte, off int64) error
+	Sync() error
+	Close() error
+}
+
+//MustBlob turns a BlobE to a Blob that panics on errors.
+func MustBlob(b BlobE) Blob {
+	return mustBlob{b}
+}
+
+type mustBlob struct {
+	b BlobE
+}
+
+func (m mustBlob) Size() int64 {
+	return m.b.Size()
+}
+
+func (m mustBlob) ReadAt(b []byte, off int64) {
+	noErr(m.b.ReadAt(b, off))
+}
+
+func (m mustBlob) WriteAt(b []byte, off int64) {
+	noErr(m.b.WriteAt(b, off))
+}
+
+func (m mustBlob) Sync() {
+	noErr(m.b.Sync())
+}
+
+func (m mustBlob) Close() {
+	noErr(m.b.Close())
+}
+
+func (m mustBlob) inMemory() bool {
+	return isInMemory(m.b)
+}
+
+//memoryBlob is a blob with data in memory, so MakeFullBuffered is not needed.
+type memoryBlob interface {
+	inMemory() bool
+}
+
+func isInMemory(b interface{}) bool {
+	m, ok := b.(memoryBlob)
+	return ok && m.inMemory()
+}
+
+func noErr(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
 type fileBlob struct {
 	f            *os.File
 	size         int64
@@ -36,6 +97,11 @@ type fileBlob struct {
 }
 
 func NewBlobFromFile(file *os.File, size int64) Blob {
+	return MustBlob(NewBlobEFromFile(file, size))
+}
+
+//NewBlobEFromFile returns a BlobE of the first size bytes of file.
+func NewBlobEFromFile(file *os.File, size int64) BlobE {
 	return &fileBlob{file, size, true}
 }
 
@@ -43,40 +109,85 @@ func (f *fileBlob) Size() int64 {
 	return f.size
 }
 
-func (f *fileBlob) ReadAt(b []byte, off int64) {
+func (f *fileBlob) ReadAt(b []byte, off int64) error {
 	assertInRange(b, off, f.size)
 	n, err := f.f.ReadAt(b, off)
 	if n != len(b) || err != nil {
-		panic(fmt.Errorf("can't ReadAt:%v, %v, %v", off, n, err))
+		return fmt.Errorf("can't ReadAt:%v, %v, %v", off, n, err)
 	}
+	return nil
 }
 
-func (f *fileBlob) WriteAt(b []byte, off int64) {
+func (f *fileBlob) WriteAt(b []byte, off int64) error {
 	assertInRange(b, off, f.size)
 	n, err := f.f.WriteAt(b, off)
+	f.suppressSync = false
 	if n != len(b) || err != nil {
-		panic(fmt.Errorf("can't WriteAt:%v, %v, %v", off, n, err))
+		return fmt.Errorf("can't WriteAt:%v, %v, %v", off, n, err)
 	}
-	f.suppressSync = false
+	return nil
 }
 
-func (f *fileBlob) Sync() {
+func (f *fileBlob) Sync() error {
 	if f.suppressSync {
-		return
+		return nil
 	}
-	f.suppressSync = true
 	err := f.f.Sync()
 	if err != nil {
-		panic(err)
+		return err
 	}
+	f.suppressSync = true
+	return nil
 }
 
-func (f *fileBlob) Close() {
+func (f *fileBlob) Close() error {
 	err := f.f.Close()
-	if err != nil {
-		panic(err)
-	}
 	f.f = nil
+	return err
+}
+
+//bytesBlob is a BlobE backed by a []byte, it has no errors.
+type bytesBlob struct {
+	b []byte
+}
+
+//NewBlobFromBytes returns a Blob that reads and writes b.
+func NewBlobFromBytes(b []byte) Blob {
+	return MustBlob(NewBlobEFromBytes(b))
+}
+
+//NewBlobEFromBytes returns a BlobE that reads and writes b.
+func NewBlobEFromBytes(b []byte) BlobE {
+	return &bytesBlob{b}
+}
+
+func (m *bytesBlob) Size() int64 {
+	return int64(len(m.b))
+}
+
+func (m *bytesBlob) ReadAt(b []byte, off int64) error {
+	assertInRange(b, off, int64(len(m.b)))
+	copy(b, m.b[off:])
+	return nil
+}
+
+func (m *bytesBlob) WriteAt(b []byte, off int64) error {
+	assertInRange(b, off, int64(len(m.b)))
+	copy(m.b[off:], b)
+	return nil
+}
+
+func (m *bytesBlob) Sync() error {
+	return nil
+}
+
+func (m *bytesBlob) Close() error {
+	m.b = nil
+	return nil
+}
+
+func (m *bytesBlob) inMemory() bool {
+	return true
 }
 
 func assertInRange(buf []byte, off int64, size int64) {
@@ -129,12 +240,82 @@ func (s *subBlob) Close() {
 	s.blob = nil
 }
 
+func (s *subBlob) inMemory() bool {
+	return isInMemory(s.blob)
+}
+
+type subBlobE struct {
+	blob  BlobE
+	start int64
+	size  int64
+}
+
+//SubBlobE is SubBlob of a BlobE.
+func SubBlobE(b BlobE, from, size int64) BlobE {
+	return &subBlobE{b, from, size}
+}
+
+func (s *subBlobE) Size() int64 {
+	return s.size
+}
+
+func (s *subBlobE) ReadAt(b []byte, off int64) error {
+	assertInRange(b, off, s.size)
+	return s.blob.ReadAt(b, off+s.start)
+}
+
+func (s *subBlobE) WriteAt(b []byte, off int64) error {
+	assertInRange(b, off, s.size)
+	return s.blob.WriteAt(b, off+s.start)
+}
+
+func (s *subBlobE) Sync() error {
+	return s.blob.Sync()
+}
+
+func (s *subBlobE) Close() error {
+	s.blob = nil
+	return nil
+}
+
+func (s *subBlobE) inMemory() bool {
+	return isInMemory(s.blob)
+}
+
+type onCloseBlobE struct {
+	BlobE
+	f func()
+}
+
+//OnClose returns b that calls f after it's closed, once.
+func OnClose(b BlobE, f func()) BlobE {
+	return &onCloseBlobE{b, f}
+}
+
+func (o *onCloseBlobE) Close() error {
+	err := o.BlobE.Close()
+	if o.f != nil {
+		o.f()
+		o.f = nil
+	}
+	return err
+}
+
+func (o *onCloseBlobE) inMemory() bool {
+	return isInMemory(o.BlobE)
+}
+
 type fullBufferBlob struct {
 	blob Blob
 	buf  []byte
 }
 
+//MakeFullBuffered reads all of blob to memory, so reads don't go to blob. It
+//returns blob if it's already in memory, such as from NewMmapBlobE.
 func MakeFullBuffered(blob Blob) Blob {
+	if isInMemory(blob) {
+		return blob
+	}
 	buf := make([]byte, blob.Size())
 	blob.ReadAt(buf, 0)
 	return &fullBufferBlob{blob, buf}
@@ -158,6 +339,10 @@ func (f *fullBufferBlob) Sync() {
 	f.blob.Sync()
 }
 
+func (f *fullBufferBlob) inMemory() bool {
+	return true
+}
+
 func (f *fullBufferBlob) Close() {
 	f.blob.Close()
 	f.blob = nil
@@ -18,7 +18,7 @@ it should only flash after the main data flushes.
 
 
 Currently, it appears that file read can be an expansive operation,
-cached or not. Use MakeFullBuffered.
+cached or not. Use MakeFullBuffered, or a blob from NewMmapBlobE.
 */
 type BlobBackedBitSet struct {
 	blob    Blob
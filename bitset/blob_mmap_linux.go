@@ -0,0 +1,95 @@
+package bitset
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+
+	"golang.org/x/sys/unix"
+)
+
+//mmapBlob is a BlobE of a file mapped to memory, reads and writes are copies
+//from and to the page cache, without system calls.
+type mmapBlob struct {
+	f     *os.File
+	data  []byte
+	dirty bool
+}
+
+//NewMmapBlobE maps the first size bytes of file to memory, the file must be
+//at least size long and stay so. The file is closed by Close.
+//
+//An I/O error while reading or writing the memory is a fault, that is turned
+//to an error.
+func NewMmapBlobE(file *os.File, size int64) (BlobE, error) {
+	if size == 0 {
+		return NewBlobEFromFile(file, size), nil //can't map nothing
+	}
+	if int64(int(size)) != size {
+		return nil, fmt.Errorf("can't map %v bytes", size)
+	}
+	data, err := unix.Mmap(int(file.Fd()), 0, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return &mmapBlob{f: file, data: data}, nil
+}
+
+func (m *mmapBlob) Size() int64 {
+	return int64(len(m.data))
+}
+
+func (m *mmapBlob) ReadAt(b []byte, off int64) (err error) {
+	assertInRange(b, off, m.Size())
+	defer catchFault(&err)()
+	copy(b, m.data[off:])
+	return nil
+}
+
+func (m *mmapBlob) WriteAt(b []byte, off int64) (err error) {
+	assertInRange(b, off, m.Size())
+	m.dirty = true
+	defer catchFault(&err)()
+	copy(m.data[off:], b)
+	return nil
+}
+
+//Sync uses msync, which also writes changes made by other mmapBlob of the
+//same file.
+func (m *mmapBlob) Sync() error {
+	if !m.dirty {
+		return nil
+	}
+	err := unix.Msync(m.data, unix.MS_SYNC)
+	if err != nil {
+		return err
+	}
+	m.dirty = false
+	return nil
+}
+
+func (m *mmapBlob) Close() error {
+	err := unix.Munmap(m.data)
+	m.data = nil
+	err2 := m.f.Close()
+	m.f = nil
+	if err != nil {
+		return err
+	}
+	return err2
+}
+
+func (m *mmapBlob) inMemory() bool {
+	return true
+}
+
+//catchFault turns a memory fault to err, use it as defer catchFault(&err)().
+func catchFault(err *error) func() {
+	old := debug.SetPanicOnFault(true)
+	return func() {
+		debug.SetPanicOnFault(old)
+		if r := recover(); r != nil {
+			*err = fmt.Errorf("mmap fault: %v", r)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package bitset
+
+import "os"
+
+//NewMmapBlobE is NewBlobEFromFile, where mmap is not supported.
+func NewMmapBlobE(file *os.File, size int64) (BlobE, error) {
+	return NewBlobEFromFile(file, size), nil
+}
@@ -0,0 +1,98 @@
+package bitset
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBlobE(t *testing.T) {
+	f, err := ioutil.TempFile("", "blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Truncate(8)
+	b := NewBlobEFromFile(f, 8)
+	if err := b.WriteAt([]byte{1, 2}, 6); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if b.ReadAt(make([]byte, 2), 0) == nil {
+		t.Error("no error reading a closed file")
+	}
+	if b.WriteAt(make([]byte, 2), 0) == nil {
+		t.Error("no error writing a closed file")
+	}
+	if b.Sync() == nil {
+		t.Error("no error syncing a closed file")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("MustBlob did not panic")
+		}
+	}()
+	MustBlob(b).ReadAt(make([]byte, 2), 0)
+}
+
+func TestBlobEFromBytes(t *testing.T) {
+	data := make([]byte, 4)
+	b := MustBlob(SubBlobE(NewBlobEFromBytes(data), 1, 2))
+	b.WriteAt([]byte{5, 6}, 0)
+	out := make([]byte, 1)
+	b.ReadAt(out, 1)
+	if out[0] != 6 || data[1] != 5 || data[2] != 6 {
+		t.Error("unexpected:", data, out)
+	}
+}
+
+func TestOnClose(t *testing.T) {
+	closed := 0
+	b := OnClose(NewBlobEFromBytes(make([]byte, 4)), func() { closed++ })
+	if !isInMemory(b) {
+		t.Error("in memory blob not reported")
+	}
+	b.Close()
+	b.Close()
+	if closed != 1 {
+		t.Error("closed", closed, "times")
+	}
+}
+
+func TestMmapBlob(t *testing.T) {
+	f, err := ioutil.TempFile("", "mmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := f.Name()
+	defer os.Remove(name)
+	f.Truncate(8 + CountBytes)
+	b, err := NewMmapBlobE(f, 8+CountBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := MustBlob(b)
+	if isInMemory(b) != (MakeFullBuffered(blob) == blob) {
+		t.Error("mapped blob copied to memory")
+	}
+	c := NewCounting(blob, 64)
+	c.Set(3)
+	c.Set(60)
+	c.Sync()
+	blob.Close()
+
+	f, err = os.OpenFile(name, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = NewMmapBlobE(f, 8+CountBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = NewCounting(MustBlob(b), 64)
+	if !c.Get(3) || !c.Get(60) || c.Get(4) || c.Count() != 2 {
+		t.Error("bits not saved", c.Count())
+	}
+	b.Close()
+}
@@ -1,18 +1,14 @@
 package bitset
 
+//FindOffBitFrom returns the index of the first 0 bit of blob from fromBit,
+//as a BlobBackedBitSet, counted from fromBit, in length bits, or -1 if none.
 func FindOffBitFrom(blob Blob, fromBit, length int) (index int) {
-	fromByte := (fromBit + 7) / 8
-	sizeByte := (fromBit+length+7)/8 - fromByte
-	sub := SubBlob(blob, int64(fromByte), int64(sizeByte))
-	//sub = MakeFullBuffered(sub)
-	startBitOffset := fromBit - fromByte*8
-	subset := NewBlobBacked(sub, startBitOffset+length)
-	for i := startBitOffset; i < startBitOffset+length; i++ {
-		if !subset.Get(i) {
-			return i - startBitOffset
-		}
+	b := &BlobBackedBitSet{blob: blob, bits: fromBit + length}
+	index = b.NextClear(fromBit)
+	if index < 0 {
+		return -1
 	}
-	return -1
+	return index - fromBit
 }
 
 // a bitset for list the index of 0s
@@ -27,14 +23,16 @@ func NewNextZeroBitSet(s *SimpleBitSet) *NextZeroBitSet {
 
 // the next 0 bit, indexed from 0 to cap-1, index is undefined if done
 func (n *NextZeroBitSet) Next() (index int, done bool) {
-	for ; n.pos < n.Capacity(); n.pos++ {
-		if !n.Get(n.pos) {
-			n.pos++
-			return n.pos - 1, false
-		}
-		// todo: skip words with all 1s
+	if n.pos >= n.Capacity() {
+		return -1, true
+	}
+	index = n.NextClear(n.pos)
+	if index < 0 {
+		n.pos = n.Capacity()
+		return -1, true
 	}
-	return -1, true
+	n.pos = index + 1
+	return index, false
 }
 
 // the next 0 bits, length is the number of consecutive 0s including the first,
@@ -0,0 +1,181 @@
+package bitset
+
+import (
+	"math/bits"
+)
+
+//wordBitSet reads a bitset a word at a time, bit k is bit k%_W of word k/_W.
+//Bits from Capacity to the end of the last word can be anything.
+type wordBitSet interface {
+	word(i int) Word
+	Capacity() int
+}
+
+//rank counts the set bits before i.
+func rank(s wordBitSet, i int) int {
+	checkIndex(i, s.Capacity()+1)
+	n := 0
+	for w := 0; w < i/_W; w++ {
+		n += bits.OnesCount(uint(s.word(w)))
+	}
+	if r := uint(i % _W); r > 0 {
+		n += bits.OnesCount(uint(s.word(i/_W) & (1<<r - 1)))
+	}
+	return n
+}
+
+//selectBit returns the index of the set bit of rank k, or -1.
+func selectBit(s wordBitSet, k int) int {
+	if k < 0 {
+		return -1
+	}
+	for w := 0; w*_W < s.Capacity(); w++ {
+		word := s.word(w)
+		c := bits.OnesCount(uint(word))
+		if k >= c {
+			k -= c
+			continue
+		}
+		for ; k > 0; k-- {
+			word &= word - 1 //drop the lowest set bit
+		}
+		i := w*_W + bits.TrailingZeros(uint(word))
+		if i >= s.Capacity() {
+			return -1
+		}
+		return i
+	}
+	return -1
+}
+
+//next returns the first index from i with the bit set as set, or -1. Words
+//without such bit are skipped whole.
+func next(s wordBitSet, i int, set bool) int {
+	checkIndex(i, s.Capacity()+1)
+	for w := i / _W; w*_W < s.Capacity(); w++ {
+		word := s.word(w)
+		if !set {
+			word = ^word
+		}
+		if w == i/_W {
+			word &= _m << uint(i%_W)
+		}
+		if word != 0 {
+			j := w*_W + bits.TrailingZeros(uint(word))
+			if j >= s.Capacity() {
+				return -1
+			}
+			return j
+		}
+	}
+	return -1
+}
+
+//runs calls f with each run of bits set as set in from to to, until f
+//returns false.
+func runs(s wordBitSet, from, to int, set bool, f func(start, length int) bool) {
+	checkIndex(to, s.Capacity()+1)
+	for i := from; i < to; {
+		start := next(s, i, set)
+		if start < 0 || start >= to {
+			return
+		}
+		end := next(s, start, !set)
+		if end < 0 || end > to {
+			end = to
+		}
+		if !f(start, end-start) {
+			return
+		}
+		i = end
+	}
+}
+
+func (s *SimpleBitSet) word(i int) Word {
+	return s.d[i]
+}
+
+//Rank returns the number of set bits before i, i can be Capacity.
+func (s *SimpleBitSet) Rank(i int) int { return rank(s, i) }
+
+//Select returns the index of the set bit with k set bits before it, or -1 if
+//there are not that many, so Rank(Select(k)) == k.
+func (s *SimpleBitSet) Select(k int) int { return selectBit(s, k) }
+
+//NextSet returns the first set bit from i, or -1 if none.
+func (s *SimpleBitSet) NextSet(i int) int { return next(s, i, true) }
+
+//NextClear returns the first unset bit from i, or -1 if none.
+func (s *SimpleBitSet) NextClear(i int) int { return next(s, i, false) }
+
+//Runs calls f with the start and length of each run of bits in from to to,
+//that are set if set is true, else unset, until f returns false.
+func (s *SimpleBitSet) Runs(from, to int, set bool, f func(start, length int) bool) {
+	runs(s, from, to, set, f)
+}
+
+//blobWords reads the words of a BlobBackedBitSet a blobWriteBlock at a time,
+//with the changes not yet flushed.
+type blobWords struct {
+	*BlobBackedBitSet
+	block int
+	words []Word
+}
+
+func (b *BlobBackedBitSet) words() *blobWords {
+	return &blobWords{BlobBackedBitSet: b, block: -1}
+}
+
+func (r *blobWords) word(i int) Word {
+	const blockWords = blobWriteBlock / _S
+	block := i / blockWords
+	if block != r.block {
+		r.load(block)
+	}
+	return r.words[i-block*blockWords]
+}
+
+func (r *blobWords) load(block int) {
+	start := block * blobWriteBlock
+	buf := make([]byte, minInt(blobWriteBlock, int(r.FileByteLength())-start))
+	r.blob.ReadAt(buf, int64(start))
+	for k, v := range r.changes[block] {
+		maskBucket, mask := r.locateByteMask(k)
+		if v {
+			buf[maskBucket] |= mask
+		} else {
+			buf[maskBucket] &^= mask
+		}
+	}
+	r.words = make([]Word, (len(buf)+_S-1)/_S)
+	for k, c := range buf {
+		r.words[k/_S] |= Word(c) << uint(k%_S*8)
+	}
+	r.block = block
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+//Rank returns the number of set bits before i, i can be Capacity.
+func (b *BlobBackedBitSet) Rank(i int) int { return rank(b.words(), i) }
+
+//Select returns the index of the set bit with k set bits before it, or -1 if
+//there are not that many, so Rank(Select(k)) == k.
+func (b *BlobBackedBitSet) Select(k int) int { return selectBit(b.words(), k) }
+
+//NextSet returns the first set bit from i, or -1 if none.
+func (b *BlobBackedBitSet) NextSet(i int) int { return next(b.words(), i, true) }
+
+//NextClear returns the first unset bit from i, or -1 if none.
+func (b *BlobBackedBitSet) NextClear(i int) int { return next(b.words(), i, false) }
+
+//Runs calls f with the start and length of each run of bits in from to to,
+//that are set if set is true, else unset, until f returns false.
+func (b *BlobBackedBitSet) Runs(from, to int, set bool, f func(start, length int) bool) {
+	runs(b.words(), from, to, set, f)
+}
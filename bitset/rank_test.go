@@ -0,0 +1,133 @@
+package bitset
+
+import (
+	"math/rand"
+	"testing"
+)
+
+type rankBitSet interface {
+	BitSet
+	Rank(i int) int
+	Select(k int) int
+	NextSet(i int) int
+	NextClear(i int) int
+	Runs(from, to int, set bool, f func(start, length int) bool)
+}
+
+//checkRank checks s against Get.
+func checkRank(t *testing.T, s rankBitSet) {
+	c := s.Capacity()
+	rank := 0
+	for i := 0; i <= c; i++ {
+		if r := s.Rank(i); r != rank {
+			t.Fatalf("rank of %v is %v, should be %v", i, r, rank)
+		}
+		if i == c {
+			break
+		}
+		if s.Get(i) {
+			if k := s.Select(rank); k != i {
+				t.Fatalf("select of %v is %v, should be %v", rank, k, i)
+			}
+			rank++
+		}
+	}
+	if k := s.Select(rank); k != -1 {
+		t.Fatalf("select of %v is %v, should be -1", rank, k)
+	}
+	for _, set := range []bool{true, false} {
+		want := -1
+		for i := c - 1; i >= 0; i-- {
+			if s.Get(i) == set {
+				want = i
+			}
+			got := s.NextClear(i)
+			if set {
+				got = s.NextSet(i)
+			}
+			if got != want {
+				t.Fatalf("next %v from %v is %v, should be %v", set, i, got, want)
+			}
+		}
+		from, to := c/3, c-c/5
+		i := from
+		s.Runs(from, to, set, func(start, length int) bool {
+			for ; i < start; i++ {
+				if s.Get(i) == set {
+					t.Fatalf("run of %v missed %v", set, i)
+				}
+			}
+			if length <= 0 {
+				t.Fatalf("run of length %v", length)
+			}
+			for ; i < start+length; i++ {
+				if s.Get(i) != set {
+					t.Fatalf("run of %v from %v of %v has %v", set, start, length, i)
+				}
+			}
+			return true
+		})
+		for ; i < to; i++ {
+			if s.Get(i) == set {
+				t.Fatalf("run of %v missed %v", set, i)
+			}
+		}
+	}
+}
+
+func fillRandom(s BitSet, r *rand.Rand) {
+	for i := 0; i < s.Capacity(); {
+		run := r.Intn(200) + 1
+		set := r.Intn(2) == 0
+		for ; run > 0 && i < s.Capacity(); run-- {
+			if set {
+				s.Set(i)
+			}
+			i++
+		}
+	}
+}
+
+func TestRankSimple(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	for _, c := range []int{0, 1, 63, 64, 65, 1000, 70001} {
+		s := NewSimple(c)
+		fillRandom(s, r)
+		checkRank(t, s)
+	}
+	s := NewSimple(130)
+	s.Set(129)
+	if s.Rank(130) != 1 || s.Select(0) != 129 || s.NextSet(0) != 129 || s.NextClear(129) != -1 {
+		t.Error("last bit not found")
+	}
+}
+
+func TestRankBlobBacked(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	for _, c := range []int{1, 63, 64, 65, 1000} {
+		s := NewBlobBacked(NewBlobFromBytes(make([]byte, bytesForbits(c))), c)
+		fillRandom(s, r)
+		checkRank(t, s)
+		s.Flush()
+		checkRank(t, s)
+	}
+	c := blobWriteBlockBits + 77
+	s := NewBlobBacked(NewBlobFromBytes(make([]byte, bytesForbits(c))), c)
+	fillRandom(s, r)
+	s.Flush()
+	checkRank(t, s)
+	for i := 0; i < c; i += r.Intn(2000) + 1 {
+		s.Unset(i) //pending changes over flushed bits
+	}
+	checkRank(t, s)
+}
+
+func TestFindOffBitFrom(t *testing.T) {
+	blob := NewBlobFromBytes([]byte{0xff, 0xff, 0x7f, 0xff})
+	if i := FindOffBitFrom(blob, 3, 21); i != 23-3 {
+		t.Error("found", i)
+	}
+	if i := FindOffBitFrom(blob, 3, 20); i != -1 {
+		t.Error("found", i)
+	}
+}
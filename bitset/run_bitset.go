@@ -0,0 +1,243 @@
+package bitset
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+//RunBitSet is a compressed bitset that keeps runs of set bits, it's small for
+//sets with long runs, such as the leafs of a file a server have.
+type RunBitSet struct {
+	runs []run //sorted, not overlapping or touching
+	c    int
+}
+
+//run is the set bits from start to end, not including end.
+type run struct {
+	start, end int
+}
+
+//RunsBitSet lists its runs of set and unset bits, such as SimpleBitSet,
+//BlobBackedBitSet, CountingBitSet, and RunBitSet.
+type RunsBitSet interface {
+	GetBitSet
+	Runs(from, to int, set bool, f func(start, length int) bool)
+}
+
+func NewRun(capacity int) *RunBitSet {
+	return &RunBitSet{c: capacity}
+}
+
+//NewRunOf returns a RunBitSet with the same bits as s.
+func NewRunOf(s RunsBitSet) *RunBitSet {
+	r := NewRun(s.Capacity())
+	s.Runs(0, s.Capacity(), true, func(start, length int) bool {
+		r.runs = append(r.runs, run{start, start + length})
+		return true
+	})
+	return r
+}
+
+//find returns the first run that ends after k.
+func (r *RunBitSet) find(k int) int {
+	return sort.Search(len(r.runs), func(i int) bool { return r.runs[i].end > k })
+}
+
+func (r *RunBitSet) Get(k int) bool {
+	checkIndex(k, r.c)
+	i := r.find(k)
+	return i < len(r.runs) && r.runs[i].start <= k
+}
+
+func (r *RunBitSet) Set(k int) {
+	if r.Get(k) {
+		return
+	}
+	i := sort.Search(len(r.runs), func(i int) bool { return r.runs[i].end >= k })
+	switch {
+	case i < len(r.runs) && r.runs[i].end == k:
+		r.runs[i].end++
+		if i+1 < len(r.runs) && r.runs[i+1].start == k+1 {
+			r.runs[i].end = r.runs[i+1].end
+			r.runs = append(r.runs[:i+1], r.runs[i+2:]...)
+		}
+	case i < len(r.runs) && r.runs[i].start == k+1:
+		r.runs[i].start--
+	default:
+		r.runs = append(r.runs, run{})
+		copy(r.runs[i+1:], r.runs[i:])
+		r.runs[i] = run{k, k + 1}
+	}
+}
+
+func (r *RunBitSet) Unset(k int) {
+	if !r.Get(k) {
+		return
+	}
+	i := r.find(k)
+	v := r.runs[i]
+	switch {
+	case v.start == k && v.end == k+1:
+		r.runs = append(r.runs[:i], r.runs[i+1:]...)
+	case v.start == k:
+		r.runs[i].start++
+	case v.end == k+1:
+		r.runs[i].end--
+	default:
+		r.runs = append(r.runs, run{})
+		copy(r.runs[i+1:], r.runs[i:])
+		r.runs[i].end = k
+		r.runs[i+1].start = k + 1
+	}
+}
+
+func (r *RunBitSet) Capacity() int { return r.c }
+
+//Count returns the number of set bits.
+func (r *RunBitSet) Count() int {
+	n := 0
+	for _, v := range r.runs {
+		n += v.end - v.start
+	}
+	return n
+}
+
+//Runs calls f with the start and length of each run of bits in from to to,
+//that are set if set is true, else unset, until f returns false.
+func (r *RunBitSet) Runs(from, to int, set bool, f func(start, length int) bool) {
+	checkIndex(to, r.c+1)
+	prev := from
+	for i := r.find(from); i < len(r.runs) && r.runs[i].start < to; i++ {
+		start, end := maxInt(r.runs[i].start, from), minInt(r.runs[i].end, to)
+		if set {
+			if !f(start, end-start) {
+				return
+			}
+		} else if start > prev && !f(prev, start-prev) {
+			return
+		}
+		prev = end
+	}
+	if !set && prev < to {
+		f(prev, to-prev)
+	}
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+//And returns the bits set in both r and o.
+func (r *RunBitSet) And(o *RunBitSet) *RunBitSet {
+	return r.combine(o, func(a, b bool) bool { return a && b })
+}
+
+//Or returns the bits set in r or o.
+func (r *RunBitSet) Or(o *RunBitSet) *RunBitSet {
+	return r.combine(o, func(a, b bool) bool { return a || b })
+}
+
+//AndNot returns the bits set in r but not o.
+func (r *RunBitSet) AndNot(o *RunBitSet) *RunBitSet {
+	return r.combine(o, func(a, b bool) bool { return a && !b })
+}
+
+//combine walks the runs of r and o together, op must be false when both are.
+func (r *RunBitSet) combine(o *RunBitSet, op func(a, b bool) bool) *RunBitSet {
+	if r.c != o.c {
+		panic(fmt.Errorf("bitset: capacity %v and %v mismatch", r.c, o.c))
+	}
+	out := NewRun(r.c)
+	a, b := r.runs, o.runs
+	pos := 0
+	for len(a) > 0 || len(b) > 0 {
+		inA, inB := len(a) > 0 && a[0].start <= pos, len(b) > 0 && b[0].start <= pos
+		next := r.c
+		if len(a) > 0 {
+			next = edge(a[0], inA)
+		}
+		if len(b) > 0 {
+			next = minInt(next, edge(b[0], inB))
+		}
+		if op(inA, inB) {
+			if n := len(out.runs); n > 0 && out.runs[n-1].end == pos {
+				out.runs[n-1].end = next
+			} else {
+				out.runs = append(out.runs, run{pos, next})
+			}
+		}
+		pos = next
+		if len(a) > 0 && a[0].end == pos {
+			a = a[1:]
+		}
+		if len(b) > 0 && b[0].end == pos {
+			b = b[1:]
+		}
+	}
+	return out
+}
+
+//edge returns where v starts, or ends if in it.
+func edge(v run, in bool) int {
+	if in {
+		return v.end
+	}
+	return v.start
+}
+
+//MarshalBinary encodes r as uvarints of: the capacity, the number of runs, then
+//for each run, the unset bits before it and its length.
+func (r *RunBitSet) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 0, (2+2*len(r.runs))*binary.MaxVarintLen32)
+	var tmp [binary.MaxVarintLen64]byte
+	put := func(x int) {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(x))]...)
+	}
+	put(r.c)
+	put(len(r.runs))
+	prev := 0
+	for _, v := range r.runs {
+		put(v.start - prev)
+		put(v.end - v.start)
+		prev = v.end
+	}
+	return buf, nil
+}
+
+//UnmarshalBinary decodes data from MarshalBinary into r.
+func (r *RunBitSet) UnmarshalBinary(data []byte) error {
+	bad := fmt.Errorf("bitset: bad run encoding")
+	get := func() int {
+		x, n := binary.Uvarint(data)
+		if n <= 0 || x > uint64(^uint(0)>>1) {
+			data = nil
+			return -1
+		}
+		data = data[n:]
+		return int(x)
+	}
+	c := get()
+	n := get()
+	if c < 0 || n < 0 || n > len(data) {
+		return bad
+	}
+	runs := make([]run, n)
+	prev := 0
+	for i := range runs {
+		gap, length := get(), get()
+		if gap < 0 || length <= 0 || (i > 0 && gap == 0) || c-prev < gap || c-prev-gap < length {
+			return bad
+		}
+		runs[i] = run{prev + gap, prev + gap + length}
+		prev = runs[i].end
+	}
+	if len(data) != 0 {
+		return bad
+	}
+	r.runs, r.c = runs, c
+	return nil
+}
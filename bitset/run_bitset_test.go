@@ -0,0 +1,167 @@
+package bitset
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestRunBitSet(t *testing.T) {
+	checkAll(t, NewRun(100), 100)
+	tryOutSide(NewRun(100), 100, t)
+	tryOutSide(NewRun(100), -1, t)
+
+	r := rand.New(rand.NewSource(0))
+	s := NewRun(1000)
+	fillRandom(s, r)
+	for i := 0; i < 500; i++ {
+		k := r.Intn(1000)
+		if r.Intn(2) == 0 {
+			s.Set(k)
+		} else {
+			s.Unset(k)
+		}
+	}
+	checkRuns(t, s)
+	checkRank(t, runRank{s})
+}
+
+//checkRuns checks that runs are sorted, not empty, and don't touch.
+func checkRuns(t *testing.T, s *RunBitSet) {
+	for i, v := range s.runs {
+		if v.start >= v.end || (i > 0 && s.runs[i-1].end >= v.start) || v.end > s.c {
+			t.Fatalf("bad run %v at %v in %v", v, i, s.runs)
+		}
+	}
+}
+
+//runRank adds the methods needed by checkRank to a RunBitSet, using Runs.
+type runRank struct {
+	*RunBitSet
+}
+
+func (r runRank) Rank(i int) int {
+	n := 0
+	r.Runs(0, i, true, func(start, length int) bool {
+		n += length
+		return true
+	})
+	return n
+}
+
+func (r runRank) Select(k int) int {
+	index := -1
+	r.Runs(0, r.c, true, func(start, length int) bool {
+		if k < length {
+			index = start + k
+			return false
+		}
+		k -= length
+		return true
+	})
+	if k < 0 {
+		return -1
+	}
+	return index
+}
+
+func (r runRank) NextSet(i int) int   { return r.next(i, true) }
+func (r runRank) NextClear(i int) int { return r.next(i, false) }
+
+func (r runRank) next(i int, set bool) int {
+	index := -1
+	r.Runs(i, r.c, set, func(start, length int) bool {
+		index = start
+		return false
+	})
+	return index
+}
+
+func TestRunBitSetAlgebra(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	for _, c := range []int{0, 1, 100, 5000} {
+		a, b := NewSimple(c), NewSimple(c)
+		fillRandom(a, r)
+		fillRandom(b, r)
+		ra, rb := NewRunOf(a), NewRunOf(b)
+		ops := []struct {
+			name string
+			got  *RunBitSet
+			op   func(x, y bool) bool
+		}{
+			{"and", ra.And(rb), func(x, y bool) bool { return x && y }},
+			{"or", ra.Or(rb), func(x, y bool) bool { return x || y }},
+			{"andnot", ra.AndNot(rb), func(x, y bool) bool { return x && !y }},
+		}
+		for _, o := range ops {
+			checkRuns(t, o.got)
+			for i := 0; i < c; i++ {
+				if o.got.Get(i) != o.op(a.Get(i), b.Get(i)) {
+					t.Fatalf("%v of capacity %v wrong at %v", o.name, c, i)
+				}
+			}
+		}
+	}
+}
+
+func TestRunBitSetOfCounting(t *testing.T) {
+	c := 10000
+	cs := NewCounting(NewBlobFromBytes(make([]byte, bytesForbits(c)+CountBytes)), c)
+	for i := 0; i < c; i += 7 {
+		cs.Set(i)
+	}
+	cs.Sync()
+	cs.Set(1) //not flushed
+	s := NewRunOf(cs)
+	checkRuns(t, s)
+	if s.Count() != int(cs.Count()) {
+		t.Errorf("count %v, should be %v", s.Count(), cs.Count())
+	}
+	for i := 0; i < c; i++ {
+		if s.Get(i) != cs.Get(i) {
+			t.Fatalf("wrong at %v", i)
+		}
+	}
+}
+
+func TestRunBitSetEncoding(t *testing.T) {
+	s := NewRun(1 << 20)
+	for i := 0; i < 1<<20; i += 1 << 12 {
+		for k := 0; k < 1<<10; k++ {
+			s.Set(i + k)
+		}
+	}
+	data, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) > 2048 { //raw bytes would be 128KiB
+		t.Errorf("encoding of %v runs is %v bytes", len(s.runs), len(data))
+	}
+	var d RunBitSet
+	err = d.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Capacity() != s.Capacity() || d.Count() != s.Count() || d.AndNot(s).Count() != 0 {
+		t.Error("decoded set is not the same")
+	}
+	again, _ := d.MarshalBinary()
+	if !bytes.Equal(again, data) {
+		t.Error("encoding is not stable")
+	}
+
+	bad := [][]byte{
+		nil,
+		data[:len(data)-1],
+		append(data, 0),
+		{10, 1, 5, 6},       //past capacity
+		{10, 2, 0, 2, 0, 2}, //touching runs
+		{10, 1, 0, 0},       //empty run
+	}
+	for _, b := range bad {
+		if d.UnmarshalBinary(b) == nil {
+			t.Errorf("decoded %v", b)
+		}
+	}
+}
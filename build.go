@@ -5,6 +5,7 @@ import (
 	"os/exec"
 
 	"github.com/xiegeo/fensan/bitset"
+	"github.com/xiegeo/fensan/chunker"
 	"github.com/xiegeo/fensan/hashtree"
 	"github.com/xiegeo/fensan/pb"
 	"github.com/xiegeo/fensan/pconn"
@@ -13,6 +14,7 @@ import (
 
 //make sure go get gets every sub package
 var _ = bitset.CHECK_INTEX
+var _ = chunker.DefaultConfig
 var _ = hashtree.HashSize
 var _ = &pb.StaticId{}
 var _ = pconn.SendBytes
@@ -21,6 +23,7 @@ var _ = store.FileNone
 func main() {
 	buildProtoBuf()
 	testCode("bitset")
+	testCode("chunker")
 	testCode("hashtree")
 	testCode("pb")
 	testCode("pconn")
@@ -0,0 +1,175 @@
+//Package chunker splits streams into content defined chunks, so that an edit
+//to a large file only changes the chunks around it, and the rest of the file
+//dedups against chunks already stored from previous versions.
+//
+//Cut points are found with FastCDC: a gear rolling hash with normalized
+//chunking, which keeps chunk sizes close to the average. Each chunk is hashed
+//with hashtree.NewFile into a StaticId, and the chunk ids of a stream are
+//listed in a Manifest.
+package chunker
+
+import (
+	"errors"
+	"io"
+
+	ht "github.com/xiegeo/fensan/hashtree"
+	"github.com/xiegeo/fensan/pb"
+)
+
+//Config sets the sizes of chunks in bytes.
+type Config struct {
+	MinSize int //no cut is made before MinSize, unless the stream ends
+	AvgSize int //the normal size of chunks, must be a power of 2
+	MaxSize int //chunks are always cut at MaxSize
+}
+
+//DefaultConfig makes chunks of 1MB on average, and at most 4MB like the data
+//blobs of store.
+var DefaultConfig = Config{MinSize: 256 << 10, AvgSize: 1 << 20, MaxSize: 4 << 20}
+
+//minAvgSize is the smallest AvgSize allowed, below it masks get too small to
+//be useful.
+const minAvgSize = 256
+
+var errConfig = errors.New("chunker: config must have MinSize < AvgSize < MaxSize, and AvgSize a power of 2 of at least 256")
+
+func (c Config) check() error {
+	if c.AvgSize < minAvgSize || c.AvgSize&(c.AvgSize-1) != 0 ||
+		c.MinSize < 0 || c.MinSize >= c.AvgSize || c.AvgSize >= c.MaxSize {
+		return errConfig
+	}
+	return nil
+}
+
+//Chunk is a piece of a stream.
+type Chunk struct {
+	Offset int64  //the position of Data in the stream
+	Data   []byte //only valid until the next call of Next
+	Id     *pb.StaticId
+}
+
+//Chunker reads a stream and cuts it to chunks.
+type Chunker struct {
+	r            io.Reader
+	c            Config
+	maskS, maskL uint64 //harder and easier masks, before and after AvgSize
+	buf          []byte
+	start, end   int //unused data in buf
+	off          int64
+	eof          bool
+	err          error
+}
+
+//New creates a Chunker of r using the sizes of c.
+func New(r io.Reader, c Config) (*Chunker, error) {
+	err := c.check()
+	if err != nil {
+		return nil, err
+	}
+	bits := uint(0)
+	for 1<<bits < c.AvgSize {
+		bits++
+	}
+	return &Chunker{
+		r:     r,
+		c:     c,
+		maskS: highBits(bits + 2),
+		maskL: highBits(bits - 2),
+		buf:   make([]byte, c.MaxSize),
+	}, nil
+}
+
+//highBits returns a mask of the n highest bits, these bits of the gear hash
+//depend on the most bytes in the window.
+func highBits(n uint) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+//Next returns the next chunk, or io.EOF after the last chunk.
+func (k *Chunker) Next() (*Chunk, error) {
+	if k.err != nil {
+		return nil, k.err
+	}
+	err := k.fill()
+	if err != nil {
+		k.err = err
+		return nil, err
+	}
+	if k.start == k.end {
+		k.err = io.EOF
+		return nil, io.EOF
+	}
+	data := k.buf[k.start:k.end]
+	data = data[:k.cut(data)]
+	d := ht.NewFile()
+	d.Write(data)
+	chunk := &Chunk{
+		Offset: k.off,
+		Data:   data,
+		Id:     &pb.StaticId{Hash: d.Sum(nil), Length: int64(len(data))},
+	}
+	k.start += len(data)
+	k.off += int64(len(data))
+	return chunk, nil
+}
+
+//fill moves unused data to the front of buf, and reads until buf is full or
+//the stream ends.
+func (k *Chunker) fill() error {
+	if k.eof || k.end-k.start == len(k.buf) {
+		return nil
+	}
+	k.end = copy(k.buf, k.buf[k.start:k.end])
+	k.start = 0
+	n, err := io.ReadFull(k.r, k.buf[k.end:])
+	k.end += n
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		k.eof = true
+		return nil
+	}
+	return err
+}
+
+//cut returns the length of the chunk at the start of data.
+func (k *Chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= k.c.MinSize {
+		return n
+	}
+	if n > k.c.MaxSize {
+		n = k.c.MaxSize
+	}
+	normal := k.c.AvgSize
+	if normal > n {
+		normal = n
+	}
+	var fp uint64
+	i := k.c.MinSize
+	for ; i < normal; i++ {
+		fp = fp<<1 + gear[data[i]]
+		if fp&k.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = fp<<1 + gear[data[i]]
+		if fp&k.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+//gear maps each byte to a random number. It must never change, as that moves
+//the cut points, and new chunks will not dedup with old ones.
+var gear = func() (g [256]uint64) {
+	s := uint64(0x66656e73616e) //splitmix64
+	for i := range g {
+		s += 0x9e3779b97f4a7c15
+		z := s
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		g[i] = z ^ z>>31
+	}
+	return
+}()
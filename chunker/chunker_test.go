@@ -0,0 +1,157 @@
+package chunker
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	ht "github.com/xiegeo/fensan/hashtree"
+	"github.com/xiegeo/fensan/pb"
+)
+
+var testConfig = Config{MinSize: 1 << 10, AvgSize: 4 << 10, MaxSize: 16 << 10}
+
+func randomData(length int, seed int64) []byte {
+	b := make([]byte, length)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func split(t *testing.T, data []byte, c Config) []*Chunk {
+	k, err := New(bytes.NewReader(data), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks []*Chunk
+	for {
+		chunk, err := k.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunk.Data = append([]byte(nil), chunk.Data...)
+		chunks = append(chunks, chunk)
+	}
+}
+
+func TestChunker(t *testing.T) {
+	data := randomData(1<<20+123, 1)
+	chunks := split(t, data, testConfig)
+	var joined []byte
+	for i, c := range chunks {
+		if c.Offset != int64(len(joined)) {
+			t.Fatalf("chunk %v at %v, expect %v", i, c.Offset, len(joined))
+		}
+		if len(c.Data) > testConfig.MaxSize || (len(c.Data) < testConfig.MinSize && i != len(chunks)-1) {
+			t.Fatalf("chunk %v has size %v", i, len(c.Data))
+		}
+		d := ht.NewFile()
+		d.Write(c.Data)
+		if !bytes.Equal(c.Id.Hash, d.Sum(nil)) || c.Id.Length != int64(len(c.Data)) {
+			t.Fatalf("chunk %v has a wrong id", i)
+		}
+		joined = append(joined, c.Data...)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Fatal("chunks do not make the data")
+	}
+	avg := len(data) / len(chunks)
+	if avg < testConfig.AvgSize/2 || avg > testConfig.AvgSize*2 {
+		t.Errorf("average size %v too far from %v", avg, testConfig.AvgSize)
+	}
+	if len(split(t, nil, testConfig)) != 0 {
+		t.Error("empty stream should have no chunks")
+	}
+	if c := split(t, data[:100], testConfig); len(c) != 1 || len(c[0].Data) != 100 {
+		t.Error("short stream should be one chunk")
+	}
+}
+
+func TestChunkerEdit(t *testing.T) {
+	data := randomData(1<<20, 2)
+	edited := append(append(append([]byte(nil), data[:300000]...), randomData(100, 3)...), data[300000:]...)
+	edited = edited[20000:]
+	before := make(map[string]bool)
+	for _, c := range split(t, data, testConfig) {
+		before[string(c.Id.Hash)] = true
+	}
+	after := split(t, edited, testConfig)
+	changed := 0
+	for _, c := range after {
+		if !before[string(c.Id.Hash)] {
+			changed++
+		}
+	}
+	if changed > 6 {
+		t.Errorf("%v of %v chunks changed by 2 edits", changed, len(after))
+	}
+}
+
+func TestBadConfig(t *testing.T) {
+	for _, c := range []Config{
+		{},
+		{MinSize: 100, AvgSize: 1000, MaxSize: 4000},
+		{MinSize: 2048, AvgSize: 1024, MaxSize: 4096},
+		{MinSize: 512, AvgSize: 1024, MaxSize: 1024},
+		{MinSize: 0, AvgSize: 128, MaxSize: 1024},
+	} {
+		_, err := New(bytes.NewReader(nil), c)
+		if err == nil {
+			t.Errorf("%+v accepted", c)
+		}
+	}
+	_, err := New(bytes.NewReader(nil), DefaultConfig)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	data := randomData(200000, 4)
+	var put []*pb.StaticId
+	m, err := Split(bytes.NewReader(data), testConfig, func(c *Chunk) error {
+		put = append(put, c.Id)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(put) != len(m.Chunks) || m.Length() != int64(len(data)) {
+		t.Fatal("manifest does not match chunks")
+	}
+	b, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2 := &Manifest{}
+	err = m2.UnmarshalBinary(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m2.Chunks) != len(m.Chunks) {
+		t.Fatal("chunks lost")
+	}
+	for i := range m.Chunks {
+		if !m.Chunks[i].Equal(m2.Chunks[i]) {
+			t.Fatalf("chunk %v changed from %v to %v", i, m.Chunks[i], m2.Chunks[i])
+		}
+	}
+	id, err := m.Id()
+	if err != nil || id.Length != int64(len(b)) {
+		t.Fatal(id, err)
+	}
+	for _, bad := range [][]byte{nil, b[:len(b)-1], append(b[:len(b):len(b)], 0)} {
+		if (&Manifest{}).UnmarshalBinary(bad) == nil {
+			t.Errorf("bad manifest of length %v accepted", len(bad))
+		}
+	}
+
+	first := m.Chunks[0]
+	missing := m.Missing(func(id *pb.StaticId) bool { return id != first })
+	if len(missing) != 1 || missing[0] != first {
+		t.Errorf("missing %v", missing)
+	}
+}
@@ -0,0 +1,123 @@
+package chunker
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	ht "github.com/xiegeo/fensan/hashtree"
+	"github.com/xiegeo/fensan/pb"
+)
+
+//Manifest lists the chunks of a stream in order. It is saved as a blob of its
+//own, so a large file is referenced by the StaticId of its manifest.
+//
+//The manifest blob is manifestMagic, followed by each chunk as the hash and
+//then the length in 8 bytes little endian.
+type Manifest struct {
+	Chunks []*pb.StaticId
+}
+
+const (
+	manifestMagic     = "fensan-manifest1"
+	manifestEntrySize = ht.HashSize + 8
+)
+
+var errManifestInvalid = errors.New("chunker: invalid manifest")
+
+//Split chunks all of r, calling put for each chunk so it can be stored, and
+//returns the manifest of r.
+func Split(r io.Reader, c Config, put func(chunk *Chunk) error) (*Manifest, error) {
+	k, err := New(r, c)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	for {
+		chunk, err := k.Next()
+		if err == io.EOF {
+			return m, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = put(chunk)
+		if err != nil {
+			return nil, err
+		}
+		m.Chunks = append(m.Chunks, chunk.Id)
+	}
+}
+
+//Length returns the length of the stream.
+func (m *Manifest) Length() int64 {
+	var l int64
+	for _, id := range m.Chunks {
+		l += id.Length
+	}
+	return l
+}
+
+//Missing returns the chunks that has returns false for, in order and without
+//repeats. Use it to find chunks that are not stored yet.
+func (m *Manifest) Missing(has func(id *pb.StaticId) bool) []*pb.StaticId {
+	var missing []*pb.StaticId
+	seen := make(map[string]bool)
+	for _, id := range m.Chunks {
+		key := string(id.Hash)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if !has(id) {
+			missing = append(missing, id)
+		}
+	}
+	return missing
+}
+
+func (m *Manifest) MarshalBinary() ([]byte, error) {
+	b := make([]byte, len(manifestMagic), len(manifestMagic)+len(m.Chunks)*manifestEntrySize)
+	copy(b, manifestMagic)
+	var length [8]byte
+	for _, id := range m.Chunks {
+		if len(id.Hash) != ht.HashSize || id.Length <= 0 ||
+			(id.Algorithm != nil && ht.SuiteID(*id.Algorithm) != ht.SuiteSHA256) {
+			return nil, errManifestInvalid
+		}
+		b = append(b, id.Hash...)
+		binary.LittleEndian.PutUint64(length[:], uint64(id.Length))
+		b = append(b, length[:]...)
+	}
+	return b, nil
+}
+
+func (m *Manifest) UnmarshalBinary(b []byte) error {
+	if len(b) < len(manifestMagic) || string(b[:len(manifestMagic)]) != manifestMagic ||
+		(len(b)-len(manifestMagic))%manifestEntrySize != 0 {
+		return errManifestInvalid
+	}
+	b = b[len(manifestMagic):]
+	chunks := make([]*pb.StaticId, 0, len(b)/manifestEntrySize)
+	for ; len(b) > 0; b = b[manifestEntrySize:] {
+		length := int64(binary.LittleEndian.Uint64(b[ht.HashSize:]))
+		if length <= 0 {
+			return errManifestInvalid
+		}
+		hash := append([]byte(nil), b[:ht.HashSize]...)
+		chunks = append(chunks, &pb.StaticId{Hash: hash, Length: length})
+	}
+	m.Chunks = chunks
+	return nil
+}
+
+//Id returns the StaticId of the manifest blob.
+func (m *Manifest) Id() (*pb.StaticId, error) {
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	d := ht.NewFile()
+	d.Write(b)
+	return &pb.StaticId{Hash: d.Sum(nil), Length: int64(len(b))}, nil
+}
@@ -0,0 +1,30 @@
+//Command fensan-relayout moves the blobs of folder stores from before salts to
+//the salted layout. For a database, these are the m_hash, d_data and d_state
+//folders under its path. Stop everything using the stores first.
+//
+//	fensan-relayout folder...
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/xiegeo/fensan/store"
+)
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: fensan-relayout folder...")
+		os.Exit(2)
+	}
+	for _, root := range flag.Args() {
+		moved, err := store.RelayoutFolderLV(root)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, root, err)
+			os.Exit(1)
+		}
+		fmt.Println(root, "moved", moved, "blobs")
+	}
+}
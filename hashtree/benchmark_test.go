@@ -55,3 +55,26 @@ func BenchmarkRef1K(b *testing.B) {
 func BenchmarkRef20K(b *testing.B) {
 	benchmarkSize(b, refBench, 20480)
 }
+
+var pairsBench = make([]H256, 1024)
+
+func BenchmarkInnerPureGo(b *testing.B) {
+	b.SetBytes(HashSize * 2)
+	for i := 0; i < b.N; i++ {
+		ht_sha256block(&pairsBench[0], &pairsBench[1])
+	}
+}
+
+func BenchmarkInnerFast(b *testing.B) {
+	b.SetBytes(HashSize * 2)
+	for i := 0; i < b.N; i++ {
+		innerCompressor(&pairsBench[0], &pairsBench[1])
+	}
+}
+
+func BenchmarkCompressPairs(b *testing.B) {
+	b.SetBytes(int64(len(pairsBench) * HashSize))
+	for i := 0; i < b.N; i++ {
+		CompressPairs(pairsBench)
+	}
+}
@@ -0,0 +1,200 @@
+package hashtree
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+//The partial state of treeDigest and fileDigest can be saved with
+//MarshalBinary, and restored with UnmarshalBinary to a digest created the same
+//way, such as by NewFile. Like those of crypto/sha256, the listener, padder,
+//compressor, and leaf hash are not part of the state.
+
+const (
+	treeStateMagic = "htt\x01"
+	fileStateMagic = "htf\x01"
+)
+
+var errStateInvalid = errors.New("hashtree: invalid hash state")
+
+func (d *treeDigest) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, 128)
+	b = append(b, treeStateMagic...)
+	b = append(b, byte(d.xn))
+	b = append(b, d.x[:]...)
+	b = appendUint64(b, uint64(d.len))
+	b = append(b, byte(d.sn))
+	var used uint64
+	for l := Level(0); l < d.sn; l++ {
+		if d.stack[l] != nil {
+			used |= 1 << uint(l)
+		}
+	}
+	b = appendUint64(b, used)
+	for l := Level(0); l < d.sn; l++ {
+		if d.stack[l] != nil {
+			b = append(b, d.stack[l].ToBytes()...)
+		}
+	}
+	for l := Level(0); l < d.sn; l++ {
+		b = appendUint64(b, uint64(d.innersCounter[l]))
+	}
+	return b, nil
+}
+
+func (d *treeDigest) UnmarshalBinary(b []byte) error {
+	if len(b) < len(treeStateMagic) || string(b[:len(treeStateMagic)]) != treeStateMagic {
+		return errStateInvalid
+	}
+	b = b[len(treeStateMagic):]
+	if len(b) < 1+HashSize+8+1+8 {
+		return errStateInvalid
+	}
+	xn := int(b[0])
+	if xn >= HashSize {
+		return errStateInvalid
+	}
+	var x [HashSize]byte
+	copy(x[:], b[1:])
+	b = b[1+HashSize:]
+	length, b := int64(binary.BigEndian.Uint64(b)), b[8:]
+	sn, b := Level(b[0]), b[1:]
+	if sn > MaxLevel || length < 0 {
+		return errStateInvalid
+	}
+	used, b := binary.BigEndian.Uint64(b), b[8:]
+	var stack [MaxLevel]*H256
+	for l := Level(0); l < sn; l++ {
+		if used&(1<<uint(l)) != 0 {
+			if len(b) < HashSize {
+				return errStateInvalid
+			}
+			stack[l], b = FromBytes(b), b[HashSize:]
+		}
+	}
+	if len(b) != int(sn)*8 {
+		return errStateInvalid
+	}
+	var counter [MaxLevel]Nodes
+	for l := Level(0); l < sn; l++ {
+		counter[l], b = Nodes(binary.BigEndian.Uint64(b)), b[8:]
+	}
+	d.x, d.xn, d.len, d.sn, d.stack, d.innersCounter = x, xn, length, sn, stack, counter
+	return nil
+}
+
+func (d *fileDigest) MarshalBinary() ([]byte, error) {
+	leaf, ok := d.leaf.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("hashtree: leaf hash %T can't be marshaled", d.leaf)
+	}
+	tree, ok := d.tree.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("hashtree: tree hash %T can't be marshaled", d.tree)
+	}
+	leafState, err := leaf.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	treeState, err := tree.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, len(fileStateMagic)+8*4+len(leafState)+len(treeState))
+	b = append(b, fileStateMagic...)
+	b = appendUint64(b, uint64(d.len))
+	b = appendUint64(b, uint64(d.leafBlockSize))
+	b = appendUint64(b, uint64(len(leafState)))
+	b = append(b, leafState...)
+	b = appendUint64(b, uint64(len(treeState)))
+	b = append(b, treeState...)
+	return b, nil
+}
+
+func (d *fileDigest) UnmarshalBinary(b []byte) error {
+	leaf, ok := d.leaf.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return fmt.Errorf("hashtree: leaf hash %T can't be unmarshaled", d.leaf)
+	}
+	tree, ok := d.tree.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return fmt.Errorf("hashtree: tree hash %T can't be unmarshaled", d.tree)
+	}
+	if len(b) < len(fileStateMagic)+8*3 || string(b[:len(fileStateMagic)]) != fileStateMagic {
+		return errStateInvalid
+	}
+	b = b[len(fileStateMagic):]
+	length, b := int64(binary.BigEndian.Uint64(b)), b[8:]
+	blockSize, b := int64(binary.BigEndian.Uint64(b)), b[8:]
+	if length < 0 || blockSize != d.leafBlockSize {
+		return errStateInvalid
+	}
+	leafState, b, err := consumeState(b)
+	if err != nil {
+		return err
+	}
+	treeState, b, err := consumeState(b)
+	if err != nil || len(b) != 0 {
+		return errStateInvalid
+	}
+	err = leaf.UnmarshalBinary(leafState)
+	if err != nil {
+		return err
+	}
+	err = tree.UnmarshalBinary(treeState)
+	if err != nil {
+		return err
+	}
+	d.len = length
+	return nil
+}
+
+func consumeState(b []byte) (state, rest []byte, err error) {
+	if len(b) < 8 {
+		return nil, nil, errStateInvalid
+	}
+	n := binary.BigEndian.Uint64(b)
+	b = b[8:]
+	if n > uint64(len(b)) {
+		return nil, nil, errStateInvalid
+	}
+	return b[:n], b[n:], nil
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var a [8]byte
+	binary.BigEndian.PutUint64(a[:], v)
+	return append(b, a[:]...)
+}
+
+//ResumeFile creates a HashTree like NewFile, with the state saved from
+//MarshalBinary of an other such HashTree.
+func ResumeFile(state []byte) (HashTree, error) {
+	d := NewFile()
+	err := d.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+//AppendFile resumes hashing from state of a file, with data appended from r,
+//then returns the new root hash and the new state to be saved.
+func AppendFile(state []byte, r io.Reader) (sum, newState []byte, err error) {
+	d, err := ResumeFile(state)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = io.Copy(d, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	newState, err = d.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+	return d.Sum(nil), newState, nil
+}
@@ -0,0 +1,97 @@
+package hashtree
+
+import (
+	"bytes"
+	"encoding"
+	"testing"
+)
+
+func TestFileState(t *testing.T) {
+	length := int64(9*1024 + 100)
+	data := randomData(length, 5)
+	seq := listenerRecord{}
+	d := NewFile()
+	d.SetInnerHashListener(seq.listen)
+	d.Write(data)
+	expect := d.Sum(nil)
+
+	for _, split := range []int64{0, 1, 1000, 1024, 1025, 4096, 5000, length} {
+		first := NewFile()
+		heard := listenerRecord{}
+		first.SetInnerHashListener(heard.listen)
+		first.Write(data[:split])
+		state, err := first.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resumed, err := ResumeFile(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resumed.SetInnerHashListener(heard.listen)
+		resumed.Write(data[split:])
+		got := resumed.Sum(nil)
+		if !bytes.Equal(got, expect) {
+			t.Fatalf("split %v: %x != %x", split, got, expect)
+		}
+		if len(heard) != len(seq) {
+			t.Fatalf("split %v: %v nodes heard, expect %v", split, len(heard), len(seq))
+		}
+		for n, s := range seq {
+			if h := heard[n]; len(h) != 1 || h[0] != s[0] {
+				t.Fatalf("split %v: node %v heard as %v, expect %v", split, n, h, s)
+			}
+		}
+	}
+}
+
+func TestAppendFile(t *testing.T) {
+	data := randomData(7*1024+3, 6)
+	d := NewFile()
+	d.Write(data[:2000])
+	state, _ := d.(encoding.BinaryMarshaler).MarshalBinary()
+	sum, state, err := AppendFile(state, bytes.NewReader(data[2000:5000]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, _, err = AppendFile(state, bytes.NewReader(data[5000:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Reset()
+	d.Write(data)
+	if !bytes.Equal(sum, d.Sum(nil)) {
+		t.Fatal("appended hash mismatch")
+	}
+}
+
+func TestTreeState(t *testing.T) {
+	data := randomData(HashSize*11+5, 7)
+	c := NewTree()
+	c.Write(data)
+	expect := c.Sum(nil)
+	c.Reset()
+	c.Write(data[:HashSize*6+3])
+	state, _ := c.(encoding.BinaryMarshaler).MarshalBinary()
+	r := NewTree()
+	err := r.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Write(data[HashSize*6+3:])
+	if !bytes.Equal(r.Sum(nil), expect) {
+		t.Fatal("resumed tree hash mismatch")
+	}
+}
+
+func TestBadState(t *testing.T) {
+	d := NewFile()
+	d.Write(make([]byte, 3000))
+	state, _ := d.(encoding.BinaryMarshaler).MarshalBinary()
+	for _, bad := range [][]byte{nil, state[:10], state[:len(state)-1], append(state, 0)} {
+		_, err := ResumeFile(bad)
+		if err == nil {
+			t.Errorf("bad state of length %v accepted", len(bad))
+		}
+	}
+}
@@ -30,7 +30,7 @@ var I = fileDigestSample{NewFile()}
 // Create the standard file tree hash using leaf blocks of LeafBlockSize (1kB)
 // and "crypto/sha256", and inner hash using sha256 (244's IHV) without padding.
 func NewFile() HashTree {
-	return NewFile2(LeafBlockSize, sha256.New(), NewTree2(NoPad32bytes, ht_sha256block))
+	return NewFile2(LeafBlockSize, sha256.New(), NewTree2(NoPad32bytes, innerCompressor))
 }
 
 // Create any tree hash using leaf blocks of size and leaf hash,
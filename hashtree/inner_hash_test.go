@@ -65,13 +65,23 @@ type nodeChildLength struct{ b, l, r int64 }
 var expectedCL = []nodeChildLength{
 	{1025, 1024, 1}, {2000, 1024, 2000 - 1024}, {3000, 2048, 3000 - 2048},
 	{2048, 1024, 1024},
+	{1<<33 + 5, 1 << 33, 5}, {1 << 33, 1 << 32, 1 << 32}, //above 32 bits
+}
+
+func TestHighBitMask64(t *testing.T) {
+	for _, n := range []uint64{1, 5, 1<<32 - 1, 1 << 32, 1<<33 + 5, 1<<63 + 1} {
+		m := highBitMask64(n)
+		if m == 0 || m > n || m<<1 <= n && m<<1 != 0 {
+			t.Fatalf("high bit of %x is %x", n, m)
+		}
+	}
 }
 
 func TestSplitLength(t *testing.T) {
 	for _, ex := range expectedCL {
 		l, r := SplitLength(ex.b)
 		if l != ex.l || r != ex.r {
-			t.Fatalf("test failed")
+			t.Fatalf("split %v to %v, %v", ex.b, l, r)
 		}
 	}
 }
@@ -0,0 +1,197 @@
+package hashtree
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+//An outboard file keeps every node of a hash tree apart from the data.
+//
+//It starts with a header of outboardMagic, the data length as 8 bytes little
+//endian, and the root hash. Followed by the tree listing, laid out by
+//HashPosition.
+const (
+	outboardMagic      = "fensan-outboard1"
+	outboardHeaderSize = int64(len(outboardMagic)) + 8 + HashSize
+)
+
+//OutboardSize returns the size of the outboard file for length bytes of data.
+func OutboardSize(length int64) int64 {
+	return outboardHeaderSize + HashTreeSize(I.Nodes(length))*HashSize
+}
+
+//WriteOutboard hashes length bytes from r, and writes the outboard file to w.
+//The root hash is returned.
+func WriteOutboard(w io.WriterAt, r io.Reader, length int64) ([]byte, error) {
+	d := NewFile()
+	leafs := d.Nodes(length)
+	var werr error
+	d.SetInnerHashListener(func(level Level, index Nodes, hash, left, right *H256) {
+		if werr == nil {
+			_, werr = w.WriteAt(hash.ToBytes(), outboardHeaderSize+HashPosition(leafs, level, index))
+		}
+	})
+	_, err := io.CopyN(d, r, length)
+	if err != nil {
+		return nil, err
+	}
+	root := d.Sum(nil)
+	if werr != nil {
+		return nil, werr
+	}
+	header := make([]byte, 0, outboardHeaderSize)
+	header = append(header, outboardMagic...)
+	header = append(header, make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(header[len(outboardMagic):], uint64(length))
+	header = append(header, root...)
+	_, err = w.WriteAt(header, 0)
+	if err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+//Outboard reads an outboard file.
+type Outboard struct {
+	r      io.ReaderAt
+	length int64
+	leafs  Nodes
+	root   []byte
+}
+
+//OpenOutboard reads the header of the outboard file in r.
+func OpenOutboard(r io.ReaderAt) (*Outboard, error) {
+	header := make([]byte, outboardHeaderSize)
+	_, err := r.ReadAt(header, 0)
+	if err != nil {
+		return nil, err
+	}
+	if string(header[:len(outboardMagic)]) != outboardMagic {
+		return nil, fmt.Errorf("hashtree: not an outboard file")
+	}
+	length := int64(binary.LittleEndian.Uint64(header[len(outboardMagic):]))
+	if length < 0 {
+		return nil, fmt.Errorf("hashtree: bad outboard length %v", length)
+	}
+	o := &Outboard{r, length, I.Nodes(length), header[len(outboardMagic)+8:]}
+	//make sure the file is not truncated
+	last := make([]byte, 1)
+	_, err = r.ReadAt(last, OutboardSize(length)-1)
+	if err != nil {
+		return nil, fmt.Errorf("hashtree: outboard truncated: %v", err)
+	}
+	return o, nil
+}
+
+//Length returns the length of the data in bytes.
+func (o *Outboard) Length() int64 { return o.length }
+
+//Root returns the root hash recorded in the header.
+func (o *Outboard) Root() []byte { return o.root }
+
+//Tree returns the tree listing, as used by ProveRange and NewEncoderWithTree.
+func (o *Outboard) Tree() io.ReaderAt {
+	return io.NewSectionReader(o.r, outboardHeaderSize, OutboardSize(o.length)-outboardHeaderSize)
+}
+
+//GetInnerHashes reads hashes at level from index off into hs, it can be used
+//as a HashFetcher.
+func (o *Outboard) GetInnerHashes(hs []byte, level Level, off Nodes) error {
+	n := Nodes(len(hs) / HashSize)
+	if len(hs)%HashSize != 0 || level < 0 || level >= Levels(o.leafs) ||
+		off < 0 || off+n > LevelWidth(o.leafs, level) {
+		return fmt.Errorf("hashtree: %v hashes at level %v, index %v is out of range", n, level, off)
+	}
+	_, err := o.r.ReadAt(hs, outboardHeaderSize+HashPosition(o.leafs, level, off))
+	return err
+}
+
+//ProveRange creates the proof for leafs from to to-1.
+func (o *Outboard) ProveRange(from, to Nodes) (*RangeProof, error) {
+	return ProveRange(o.Tree(), o.length, from, to)
+}
+
+//VerifyData checks the leafs from to to-1 of data against the leaf hashes,
+//a *CorruptionError is returned at the first bad leaf.
+func (o *Outboard) VerifyData(data io.ReaderAt, from, to Nodes) error {
+	err := checkRange(o.leafs, from, to)
+	if err != nil {
+		return err
+	}
+	leaf := make([]byte, LeafBlockSize)
+	hash := make([]byte, HashSize)
+	for k := from; k < to; k++ {
+		off, size := rangeBytes(o.length, k, k+1)
+		n, err := data.ReadAt(leaf[:size], off)
+		if int64(n) != size {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		err = o.GetInnerHashes(hash, 0, k)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(leaf[:size])
+		if !bytes.Equal(sum[:], hash) {
+			return &CorruptionError{k}
+		}
+	}
+	return nil
+}
+
+//outboardCheckBatch is the number of nodes checked at once by Check.
+const outboardCheckBatch = 1024
+
+//Check verifies that every inner node is derived from the nodes below it, up
+//to the root in the header.
+func (o *Outboard) Check() error {
+	levels := Levels(o.leafs)
+	parents := make([]byte, outboardCheckBatch*HashSize)
+	childs := make([]byte, 2*outboardCheckBatch*HashSize)
+	nodes := make([]H256, 2*outboardCheckBatch)
+	for l := Level(1); l < levels; l++ {
+		width := LevelWidth(o.leafs, l)
+		below := LevelWidth(o.leafs, l-1)
+		for i := Nodes(0); i < width; i += outboardCheckBatch {
+			n := width - i
+			if n > outboardCheckBatch {
+				n = outboardCheckBatch
+			}
+			c := below - i*2
+			if c > n*2 {
+				c = n * 2
+			}
+			err := o.GetInnerHashes(parents[:n*HashSize], l, i)
+			if err != nil {
+				return err
+			}
+			err = o.GetInnerHashes(childs[:c*HashSize], l-1, i*2)
+			if err != nil {
+				return err
+			}
+			for j := Nodes(0); j < c; j++ {
+				nodes[j] = *FromBytes(childs[j*HashSize:])
+			}
+			for j, h := range CompressPairs(nodes[:c]) {
+				if h != *FromBytes(parents[j*HashSize:]) {
+					first, _ := nodeLeafs(o.leafs, l, i+Nodes(j))
+					return &CorruptionError{first}
+				}
+			}
+		}
+	}
+	top := make([]byte, HashSize)
+	err := o.GetInnerHashes(top, levels-1, 0)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(top, o.root) {
+		return fmt.Errorf("hashtree: outboard root mismatch")
+	}
+	return nil
+}
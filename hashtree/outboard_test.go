@@ -0,0 +1,86 @@
+package hashtree
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestOutboard(t *testing.T) {
+	fileName := ".testOutboard"
+	defer os.Remove(fileName)
+	for _, length := range rangeProofLengths {
+		data := randomData(length, length)
+		f, err := os.Create(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, err := WriteOutboard(f, bytes.NewReader(data), length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, _ := f.Stat()
+		if fi.Size() != OutboardSize(length) {
+			t.Fatalf("length %v: outboard size %v, expected %v", length, fi.Size(), OutboardSize(length))
+		}
+
+		o, err := OpenOutboard(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o.Length() != length || !bytes.Equal(o.Root(), root) {
+			t.Fatalf("length %v: bad header", length)
+		}
+		err = o.Check()
+		if err != nil {
+			t.Fatalf("length %v: %v", length, err)
+		}
+		tree, _ := TreeListing(bytes.NewReader(data), length)
+		leafs := I.Nodes(length)
+		for l := Level(0); l < Levels(leafs); l++ {
+			hs := make([]byte, int(LevelWidth(leafs, l))*HashSize)
+			err = o.GetInnerHashes(hs, l, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := HashPosition(leafs, l, 0)
+			if !bytes.Equal(hs, tree[p:p+int64(len(hs))]) {
+				t.Fatalf("length %v: level %v mismatch", length, l)
+			}
+		}
+		err = o.VerifyData(bytes.NewReader(data), 0, leafs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if length > 0 {
+			err = o.VerifyData(bytes.NewReader(data[:length-1]), 0, leafs)
+			if err != io.ErrUnexpectedEOF {
+				t.Fatalf("length %v: short data got %v", length, err)
+			}
+		}
+		proof, err := o.ProveRange(leafs-1, leafs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		off, size := rangeBytes(length, leafs-1, leafs)
+		err = VerifyRange(root, length, proof, data[off:off+size])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if length > 2048 {
+			bad := append([]byte(nil), data...)
+			bad[2048]++
+			err = o.VerifyData(bytes.NewReader(bad), 0, leafs)
+			if ce, ok := err.(*CorruptionError); !ok || ce.Leaf != 2 {
+				t.Fatalf("expect corruption at leaf 2, got %v", err)
+			}
+			f.WriteAt(make([]byte, HashSize), outboardHeaderSize+HashPosition(leafs, 0, 2))
+			if o.Check() == nil {
+				t.Fatal("bad outboard passed check")
+			}
+		}
+		f.Close()
+	}
+}
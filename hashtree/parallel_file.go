@@ -0,0 +1,115 @@
+package hashtree
+
+import (
+	"io"
+	"sync"
+)
+
+//parallelChunkLevel is the level of subtrees hashed independently
+//by HashReaderAt, each subtree covers 1 MiB.
+const parallelChunkLevel = 10
+
+//HashReaderAt computes the same root hash as NewFile on length bytes from r,
+//with subtrees hashed by workers goroutines.
+//
+//If listener is not nil, it receives the same callbacks as SetInnerHashListener
+//would in NewFile, not in order, but never concurrently.
+func HashReaderAt(r io.ReaderAt, length int64, workers int,
+	listener func(level Level, index Nodes, hash, left, right *H256)) ([]byte, error) {
+	leafs := I.Nodes(length)
+	chunkLeafs := Nodes(1) << parallelChunkLevel
+	if workers < 2 || leafs <= chunkLeafs {
+		d := NewFile()
+		if listener != nil {
+			d.SetInnerHashListener(listener)
+		}
+		_, err := io.CopyN(d, io.NewSectionReader(r, 0, length), length)
+		if err != nil {
+			return nil, err
+		}
+		return d.Sum(nil), nil
+	}
+
+	chunks := LevelWidth(leafs, parallelChunkLevel)
+	roots := make([]*H256, chunks)
+	var mu sync.Mutex
+	var firstErr error
+	listen := func(level Level, index Nodes, hash, left, right *H256) {
+		if listener != nil {
+			mu.Lock()
+			listener(level, index, hash, left, right)
+			mu.Unlock()
+		}
+	}
+
+	todo := make(chan Nodes)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, int64(chunkLeafs)*LeafBlockSize)
+			for c := range todo {
+				root, err := hashChunk(r, length, c, buf, listen)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					continue
+				}
+				roots[c] = root
+			}
+		}()
+	}
+	for c := Nodes(0); c < chunks; c++ {
+		todo <- c
+	}
+	close(todo)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	//merge the roots of chunks, which are the base of the upper tree
+	top := NewNoPadTree()
+	top.SetInnerHashListener(func(level Level, index Nodes, hash, left, right *H256) {
+		if level > 0 {
+			listen(level+parallelChunkLevel, index, hash, left, right)
+		}
+	})
+	for _, root := range roots {
+		top.Write(root.ToBytes())
+	}
+	return top.Sum(nil), nil
+}
+
+//hashChunk hashes the c'th subtree at parallelChunkLevel, and calls listen with
+//the indexes of the full tree.
+func hashChunk(r io.ReaderAt, length int64, c Nodes, buf []byte,
+	listen func(level Level, index Nodes, hash, left, right *H256)) (*H256, error) {
+	off := int64(c) * int64(len(buf))
+	size := int64(len(buf))
+	if off+size > length {
+		size = length - off
+	}
+	n, err := r.ReadAt(buf[:size], off)
+	if int64(n) != size {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	d := NewFile()
+	d.SetInnerHashListener(func(level Level, index Nodes, hash, left, right *H256) {
+		listen(level, index+c<<uint(parallelChunkLevel-level), hash, left, right)
+	})
+	d.Write(buf[:size])
+	root := FromBytes(d.Sum(nil))
+	//the last chunk could be short, promote it's root up to parallelChunkLevel
+	for l := Levels(d.Nodes(size)); l <= parallelChunkLevel; l++ {
+		listen(l, c<<uint(parallelChunkLevel-l), root, root, nil)
+	}
+	return root, nil
+}
@@ -0,0 +1,95 @@
+package hashtree
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"testing"
+)
+
+type listenerRecord map[nodeIndex][]string
+
+func (r listenerRecord) listen(level Level, index Nodes, hash, left, right *H256) {
+	n := nodeIndex{level, index}
+	r[n] = append(r[n], fmt.Sprint(*hash, left, right))
+}
+
+func TestHashReaderAt(t *testing.T) {
+	mb := int64(1 << 20)
+	lengths := []int64{0, 1000, mb, mb + 1, 2 * mb, 3*mb + 5, 4*mb + 1024, 5*mb - 3000}
+	for _, length := range lengths {
+		data := randomData(length, length)
+		seq := listenerRecord{}
+		leafs := I.Nodes(length)
+		tree := make([]byte, HashPosition(leafs, Levels(leafs), 0))
+		d := NewFile()
+		d.SetInnerHashListener(func(level Level, index Nodes, hash, left, right *H256) {
+			seq.listen(level, index, hash, left, right)
+			copy(tree[HashPosition(leafs, level, index):], hash.ToBytes())
+		})
+		d.Write(data)
+		expect := d.Sum(nil)
+
+		for _, workers := range []int{1, 3, 8} {
+			par := listenerRecord{}
+			got, err := HashReaderAt(bytes.NewReader(data), length, workers,
+				func(level Level, index Nodes, hash, left, right *H256) {
+					par.listen(level, index, hash, left, right)
+					at := HashPosition(leafs, level, index)
+					if at+HashSize > int64(len(tree)) || !bytes.Equal(hash.ToBytes(), tree[at:at+HashSize]) {
+						t.Errorf("length %v, workers %v: node %v, %v is not at %v", length, workers, level, index, at)
+					}
+				})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, expect) {
+				t.Fatalf("length %v, workers %v: root %x != %x", length, workers, got, expect)
+			}
+			if len(par) != len(seq) {
+				t.Fatalf("length %v, workers %v: %v nodes heard, expect %v", length, workers, len(par), len(seq))
+			}
+			for n, s := range seq {
+				p := par[n]
+				sort.Strings(p)
+				sort.Strings(s)
+				if fmt.Sprint(p) != fmt.Sprint(s) {
+					t.Fatalf("length %v, workers %v: node %v heard as %v, expect %v", length, workers, n, p, s)
+				}
+			}
+		}
+	}
+}
+
+//shortReader returns n < len(p) with no error from the second MiB.
+type shortReader struct {
+	*bytes.Reader
+}
+
+func (r shortReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= 1<<20 && len(p) > 1 {
+		p = p[:len(p)-1]
+	}
+	n, err := r.Reader.ReadAt(p, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func TestHashReaderAtShortRead(t *testing.T) {
+	data := randomData(3<<20, 1)
+	_, err := HashReaderAt(shortReader{bytes.NewReader(data)}, int64(len(data)), 3, nil)
+	if err != io.ErrUnexpectedEOF {
+		t.Error("short read got:", err)
+	}
+}
+
+func BenchmarkHashReaderAt(b *testing.B) {
+	data := make([]byte, 16<<20)
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		HashReaderAt(bytes.NewReader(data), int64(len(data)), 8, nil)
+	}
+}
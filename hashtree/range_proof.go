@@ -0,0 +1,204 @@
+package hashtree
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+//RangeProof proves that the leafs From to To-1 belong to a tree,
+//it holds the minimal set of inner hashes needed to derive the root hash
+//from the data of the leafs.
+type RangeProof struct {
+	From   Nodes  //the first leaf in range
+	To     Nodes  //one past the last leaf in range
+	Hashes []byte //sibling hashes in pre-order, from left to right
+}
+
+//TreeListing is Suite.TreeListing of SuiteSHA256.
+func TreeListing(r io.Reader, length int64) ([]byte, error) {
+	return suites[SuiteSHA256].TreeListing(r, length)
+}
+
+//TreeListing hashes length bytes read from r using s.NewFile, and returns every
+//node of the tree, from leaf hashes to the root, laid out by HashPosition.
+func (s *Suite) TreeListing(r io.Reader, length int64) ([]byte, error) {
+	d := s.NewFile()
+	leafs := d.Nodes(length)
+	tree := make([]byte, HashTreeSize(leafs)*HashSize)
+	d.SetInnerHashListener(func(level Level, index Nodes, hash, left, right *H256) {
+		copy(tree[HashPosition(leafs, level, index):], hash.ToBytes())
+	})
+	_, err := io.CopyN(d, r, length)
+	if err != nil {
+		return nil, err
+	}
+	d.Sum(nil)
+	return tree, nil
+}
+
+//nodeLeafs returns the range of leafs, from a to b-1, covered by the node
+//at level l and index i.
+func nodeLeafs(leafs Nodes, l Level, i Nodes) (a, b Nodes) {
+	a = i << uint(l)
+	b = (i + 1) << uint(l)
+	if b > leafs {
+		b = leafs
+	}
+	return
+}
+
+//hasRightChild reports if the node at level l (> 0) and index i is hashed from
+//two children, or promoted from it's only child on the right edge.
+func hasRightChild(leafs Nodes, l Level, i Nodes) bool {
+	return i*2+1 < LevelWidth(leafs, l-1)
+}
+
+//rangeBytes returns the bytes of data covered by the leafs from to to-1.
+func rangeBytes(length int64, from, to Nodes) (off, size int64) {
+	off = int64(from) * LeafBlockSize
+	end := int64(to) * LeafBlockSize
+	if end > length {
+		end = length
+	}
+	return off, end - off
+}
+
+func checkRange(leafs Nodes, from, to Nodes) error {
+	if from < 0 || from >= to || to > leafs {
+		return fmt.Errorf("leaf range %v to %v is outside of 0 to %v", from, to, leafs)
+	}
+	return nil
+}
+
+//ProveRange creates the proof for leafs from to to-1 of the data of length
+//bytes, where tree is the full listing of the tree as from TreeListing.
+//Only the sibling hashes are read from tree.
+func ProveRange(tree io.ReaderAt, length int64, from, to Nodes) (*RangeProof, error) {
+	leafs := I.Nodes(length)
+	err := checkRange(leafs, from, to)
+	if err != nil {
+		return nil, err
+	}
+	p := &rangeProver{tree: tree, leafs: leafs, from: from, to: to}
+	err = p.node(Levels(leafs)-1, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &RangeProof{from, to, p.hashes}, nil
+}
+
+type rangeProver struct {
+	tree     io.ReaderAt
+	leafs    Nodes
+	from, to Nodes
+	hashes   []byte
+}
+
+func (p *rangeProver) node(l Level, i Nodes) error {
+	a, b := nodeLeafs(p.leafs, l, i)
+	if b <= p.from || a >= p.to {
+		h := make([]byte, HashSize)
+		_, err := p.tree.ReadAt(h, HashPosition(p.leafs, l, i))
+		if err != nil {
+			return err
+		}
+		p.hashes = append(p.hashes, h...)
+		return nil
+	}
+	if a >= p.from && b <= p.to {
+		return nil //derived from data
+	}
+	err := p.node(l-1, i*2)
+	if err != nil || !hasRightChild(p.leafs, l, i) {
+		return err
+	}
+	return p.node(l-1, i*2+1)
+}
+
+//VerifyRange is Suite.VerifyRange of SuiteSHA256.
+func VerifyRange(root []byte, length int64, proof *RangeProof, data []byte) error {
+	return suites[SuiteSHA256].VerifyRange(root, length, proof, data)
+}
+
+//VerifyRange checks that data, as the leafs from proof.From to proof.To-1,
+//is part of the file identified by root and length, hashed by s.
+func (s *Suite) VerifyRange(root []byte, length int64, proof *RangeProof, data []byte) error {
+	leafs := I.Nodes(length)
+	err := checkRange(leafs, proof.From, proof.To)
+	if err != nil {
+		return err
+	}
+	_, size := rangeBytes(length, proof.From, proof.To)
+	if int64(len(data)) != size {
+		return fmt.Errorf("data length %v, expected %v", len(data), size)
+	}
+	if len(proof.Hashes)%HashSize != 0 {
+		return fmt.Errorf("proof is not multiples of hashes")
+	}
+	used := 0
+	v := &rangeVerifier{suite: s, leafs: leafs, length: length, from: proof.From, to: proof.To, data: data}
+	v.sibling = func(l Level, i Nodes) (*H256, error) {
+		if used+HashSize > len(proof.Hashes) {
+			return nil, fmt.Errorf("proof is too short")
+		}
+		h := FromBytes(proof.Hashes[used:])
+		used += HashSize
+		return h, nil
+	}
+	h, err := v.node(Levels(leafs)-1, 0)
+	if err != nil {
+		return err
+	}
+	if len(proof.Hashes) != used {
+		return fmt.Errorf("proof has %v unused bytes", len(proof.Hashes)-used)
+	}
+	if !bytes.Equal(h.ToBytes(), root) {
+		return fmt.Errorf("root hash mismatch")
+	}
+	return nil
+}
+
+//rangeVerifier computes the hash of a node from data of leafs from to to-1,
+//and the hashes of siblings.
+type rangeVerifier struct {
+	suite    *Suite
+	leafs    Nodes
+	length   int64
+	from, to Nodes
+	data     []byte
+	sibling  func(l Level, i Nodes) (*H256, error) //gets a node outside of range
+	listener func(l Level, i Nodes, hash *H256)    //optional, receives computed nodes
+}
+
+func (v *rangeVerifier) node(l Level, i Nodes) (*H256, error) {
+	a, b := nodeLeafs(v.leafs, l, i)
+	if b <= v.from || a >= v.to {
+		return v.sibling(l, i)
+	}
+	var h *H256
+	if a >= v.from && b <= v.to {
+		start := int64(v.from) * LeafBlockSize
+		off, size := rangeBytes(v.length, a, b)
+		d := v.suite.NewFile()
+		d.Write(v.data[off-start : off-start+size])
+		h = FromBytes(d.Sum(nil))
+	} else {
+		left, err := v.node(l-1, i*2)
+		if err != nil {
+			return nil, err
+		}
+		h = left
+		if hasRightChild(v.leafs, l, i) {
+			right, err := v.node(l-1, i*2+1)
+			if err != nil {
+				return nil, err
+			}
+			h = v.suite.Compressor(left, right)
+		}
+	}
+	if v.listener != nil {
+		v.listener(l, i, h)
+	}
+	return h, nil
+}
@@ -0,0 +1,98 @@
+package hashtree
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+var rangeProofLengths = []int64{0, 1, 1024, 1025, 2048, 3000, 5 * 1024, 8*1024 + 1, 13*1024 + 7}
+
+func randomData(length int64, seed int64) []byte {
+	data := make([]byte, length)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestTreeListing(t *testing.T) {
+	for _, length := range rangeProofLengths {
+		data := randomData(length, length)
+		tree, err := TreeListing(bytes.NewReader(data), length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := NewFile()
+		d.Write(data)
+		root := d.Sum(nil)
+		if !bytes.Equal(root, tree[len(tree)-HashSize:]) {
+			t.Errorf("length %v: root is not the last hash in listing", length)
+		}
+	}
+}
+
+func TestRangeProof(t *testing.T) {
+	for _, length := range rangeProofLengths {
+		data := randomData(length, length)
+		tree, err := TreeListing(bytes.NewReader(data), length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root := tree[len(tree)-HashSize:]
+		leafs := I.Nodes(length)
+		for from := Nodes(0); from < leafs; from++ {
+			for to := from + 1; to <= leafs; to++ {
+				proof, err := ProveRange(bytes.NewReader(tree), length, from, to)
+				if err != nil {
+					t.Fatal(err)
+				}
+				off, size := rangeBytes(length, from, to)
+				part := data[off : off+size]
+				err = VerifyRange(root, length, proof, part)
+				if err != nil {
+					t.Fatalf("length %v, range %v to %v: %v", length, from, to, err)
+				}
+				if size > 0 {
+					bad := append([]byte(nil), part...)
+					bad[len(bad)/2]++
+					if VerifyRange(root, length, proof, bad) == nil {
+						t.Fatalf("length %v, range %v to %v: bad data verified", length, from, to)
+					}
+				}
+				if len(proof.Hashes) > 0 {
+					proof.Hashes[0]++
+					if VerifyRange(root, length, proof, part) == nil {
+						t.Fatalf("length %v, range %v to %v: bad proof verified", length, from, to)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestRangeProofSize(t *testing.T) {
+	length := int64(8 * 1024)
+	tree, _ := TreeListing(bytes.NewReader(make([]byte, length)), length)
+	expect := []struct {
+		from, to Nodes
+		hashes   int
+	}{
+		{0, 8, 0}, {0, 4, 1}, {3, 4, 3}, {2, 6, 2}, {1, 7, 2}, {1, 3, 3},
+	}
+	for _, e := range expect {
+		proof, _ := ProveRange(bytes.NewReader(tree), length, e.from, e.to)
+		if len(proof.Hashes) != e.hashes*HashSize {
+			t.Errorf("range %v to %v has %v hashes, expected %v",
+				e.from, e.to, len(proof.Hashes)/HashSize, e.hashes)
+		}
+	}
+}
+
+func TestRangeProofOutOfRange(t *testing.T) {
+	tree, _ := TreeListing(bytes.NewReader(make([]byte, 3000)), 3000)
+	for _, r := range [][2]Nodes{{-1, 1}, {1, 1}, {2, 1}, {0, 4}} {
+		_, err := ProveRange(bytes.NewReader(tree), 3000, r[0], r[1])
+		if err == nil {
+			t.Errorf("range %v should fail", r)
+		}
+	}
+}
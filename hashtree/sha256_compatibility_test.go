@@ -193,3 +193,40 @@ func sha256padding(d io.Writer, len int64) {
 	}
 	d.Write(tmp[0:8])
 }
+
+// Make sure the fast inner hash using crypto/sha256 is the same as ht_sha256block.
+func TestFastInner(t *testing.T) {
+	if !fastInner {
+		t.Log("crypto/sha256 can't be used, testing fallback only")
+	}
+	data := randomData(65*HashSize, 11)
+	nodes := make([]H256, 65)
+	for i := range nodes {
+		nodes[i] = *FromBytes(data[i*HashSize:])
+	}
+	for i := 0; i+1 < len(nodes); i++ {
+		expect := ht_sha256block(&nodes[i], &nodes[i+1])
+		if *innerCompressor(&nodes[i], &nodes[i+1]) != *expect {
+			t.Fatalf("inner hash of node %v differs", i)
+		}
+		if fastInner && *fastSha256block(&nodes[i], &nodes[i+1]) != *expect {
+			t.Fatalf("fast hash of node %v differs", i)
+		}
+	}
+	for _, n := range []int{1, 2, 3, 64, 65} {
+		in := append([]H256(nil), nodes[:n]...)
+		out := CompressPairs(in)
+		if len(out) != (n+1)/2 {
+			t.Fatalf("%v nodes compressed to %v", n, len(out))
+		}
+		for i := range out {
+			expect := nodes[i*2]
+			if i*2+1 < n {
+				expect = *ht_sha256block(&nodes[i*2], &nodes[i*2+1])
+			}
+			if out[i] != expect {
+				t.Fatalf("pair %v of %v nodes differs", i, n)
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package hashtree
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"hash"
+	"sync"
+)
+
+//The inner hash is a single sha256 block with sha224's initial hash values.
+//crypto/sha256 does not export its block function, which uses SHA-NI or AVX2
+//when the cpu has them, but it can be reached by restoring a saved state with
+//the changed initial hash values, writing exactly one block, and reading the
+//state back out.
+//
+//This depends on the state format of crypto/sha256, which is not promised to
+//stay the same. innerCompressor uses the fast version only when a self test
+//at startup gives the same results as ht_sha256block, else the pure go
+//ht_sha256block is kept as fallback.
+
+const (
+	sha256StateMagic = "sha\x03"
+	sha256StateSize  = len(sha256StateMagic) + 8*4 + 64 + 8
+)
+
+var fastInner = checkFastInner()
+
+func innerCompressor(left, right *H256) *H256 {
+	if fastInner {
+		return fastSha256block(left, right)
+	}
+	return ht_sha256block(left, right)
+}
+
+//sha224IVState is a marshaled sha256 state with no data written,
+//but using sha224's initial hash values.
+var sha224IVState = func() []byte {
+	b := make([]byte, sha256StateSize)
+	copy(b, sha256StateMagic)
+	for i, v := range []uint32{init0_224, init1_224, init2_224, init3_224, init4_224, init5_224, init6_224, init7_224} {
+		binary.BigEndian.PutUint32(b[len(sha256StateMagic)+i*4:], v)
+	}
+	return b
+}()
+
+type blockHasher struct {
+	d     hash.Hash
+	block [64]byte
+	state []byte
+}
+
+var blockHasherPool = sync.Pool{New: func() interface{} {
+	return &blockHasher{d: sha256.New(), state: make([]byte, 0, sha256StateSize)}
+}}
+
+type binaryAppender interface {
+	AppendBinary(b []byte) ([]byte, error)
+}
+
+func (b *blockHasher) compress(left, right, out *H256) error {
+	err := b.d.(encoding.BinaryUnmarshaler).UnmarshalBinary(sha224IVState)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 8; i++ {
+		binary.BigEndian.PutUint32(b.block[i*4:], left[i])
+		binary.BigEndian.PutUint32(b.block[32+i*4:], right[i])
+	}
+	b.d.Write(b.block[:])
+	if a, ok := b.d.(binaryAppender); ok {
+		b.state, err = a.AppendBinary(b.state[:0])
+	} else {
+		b.state, err = b.d.(encoding.BinaryMarshaler).MarshalBinary()
+	}
+	if err != nil {
+		return err
+	}
+	if len(b.state) != sha256StateSize {
+		return errStateInvalid
+	}
+	for i := 0; i < 8; i++ {
+		out[i] = binary.BigEndian.Uint32(b.state[len(sha256StateMagic)+i*4:])
+	}
+	return nil
+}
+
+func fastSha256block(left, right *H256) *H256 {
+	b := blockHasherPool.Get().(*blockHasher)
+	h := new(H256)
+	err := b.compress(left, right, h)
+	blockHasherPool.Put(b)
+	if err != nil {
+		panic(err) //checked by checkFastInner, never happens
+	}
+	return h
+}
+
+//checkFastInner is the self test of the fast version. Any error, panic or
+//different hash keeps the fallback.
+func checkFastInner() (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	d := sha256.New()
+	_, ok1 := d.(encoding.BinaryMarshaler)
+	_, ok2 := d.(encoding.BinaryUnmarshaler)
+	if !ok1 || !ok2 {
+		return false
+	}
+	b := &blockHasher{d: d}
+	var h H256
+	var left, right H256
+	for i := uint32(0); i < 8; i++ {
+		for j := range left {
+			left[j] = i*0x9e3779b9 + uint32(j)
+			right[j] = ^left[j] >> i
+		}
+		if b.compress(&left, &right, &h) != nil || h != *ht_sha256block(&left, &right) {
+			return false
+		}
+	}
+	return true
+}
+
+//CompressPairs hashes each pair of nodes on a level of a tree to the nodes of
+//the level above, the last node is promoted when there is no pair for it.
+//The result is written over the start of nodes, and has a length of
+//(len(nodes)+1)/2. Each pair is still one block compression, what it saves
+//over innerCompressor is a pool round trip and an allocation per pair.
+func CompressPairs(nodes []H256) []H256 {
+	n := len(nodes) / 2
+	if !fastInner {
+		for i := 0; i < n; i++ {
+			nodes[i] = *ht_sha256block(&nodes[i*2], &nodes[i*2+1])
+		}
+	} else {
+		b := blockHasherPool.Get().(*blockHasher)
+		for i := 0; i < n; i++ {
+			err := b.compress(&nodes[i*2], &nodes[i*2+1], &nodes[i])
+			if err != nil {
+				panic(err)
+			}
+		}
+		blockHasherPool.Put(b)
+	}
+	if len(nodes)%2 == 1 {
+		nodes[n] = nodes[len(nodes)-1]
+		n++
+	}
+	return nodes[:n]
+}
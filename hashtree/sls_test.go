@@ -45,3 +45,23 @@ func TestSplitLocalSummable(t *testing.T) {
 		}
 	}
 }
+
+func TestSplitLocalSummableBytes(t *testing.T) {
+	hs := make([]byte, 8*2)
+	for i := range hs {
+		hs[i] = byte(i/2 + 1) //the node index
+	}
+	//nodes 1 to 8 of width 10 with hash size 2
+	got := SplitLocalSummable(hs, 2, 10, 1)
+	expect := [][]byte{{2, 2, 3, 3}, {4, 4, 5, 5, 6, 6, 7, 7}}
+	if len(got) != len(expect) {
+		t.Fatalf("got %v", got)
+	}
+	for i := range got {
+		for j := range got[i] {
+			if got[i][j] != expect[i][j] {
+				t.Fatalf("part %v, got %v, expect nodes %v", i, got[i], expect[i])
+			}
+		}
+	}
+}
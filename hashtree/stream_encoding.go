@@ -0,0 +1,225 @@
+package hashtree
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+//The combined stream encoding interleaves inner hashes with the data, so that a
+//stream can be verified as it is read (like Bao).
+//
+//The stream starts with the data length as 8 bytes little endian, followed by
+//the nodes in pre-order from the root. Each node with two children writes the
+//hashes of it's left and right child before them, a promoted node writes
+//nothing before it's only child, and a leaf writes it's data.
+
+const streamHeaderSize = 8
+
+//EncodedLength returns the length of the combined stream of length bytes of data.
+func EncodedLength(length int64) int64 {
+	return streamHeaderSize + length + int64(I.Nodes(length)-1)*2*HashSize
+}
+
+//Encoder writes data with it's inner hashes as a combined stream.
+type Encoder struct {
+	r      io.ReaderAt
+	length int64
+	leafs  Nodes
+	tree   io.ReaderAt
+}
+
+//NewEncoder creates an Encoder for length bytes of r, r is read once to hash
+//the full tree.
+func NewEncoder(r io.ReaderAt, length int64) (*Encoder, error) {
+	tree, err := TreeListing(io.NewSectionReader(r, 0, length), length)
+	if err != nil {
+		return nil, err
+	}
+	return NewEncoderWithTree(r, length, bytes.NewReader(tree)), nil
+}
+
+//NewEncoderWithTree creates an Encoder for length bytes of r, using the tree
+//listing (see TreeListing) already known.
+func NewEncoderWithTree(r io.ReaderAt, length int64, tree io.ReaderAt) *Encoder {
+	return &Encoder{r, length, I.Nodes(length), tree}
+}
+
+//WriteTo writes the combined stream to w.
+func (e *Encoder) WriteTo(w io.Writer) (n int64, err error) {
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+	header := make([]byte, streamHeaderSize)
+	binary.LittleEndian.PutUint64(header, uint64(e.length))
+	cw.Write(header)
+	err = e.node(cw, Levels(e.leafs)-1, 0)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = cw.err
+	}
+	return cw.n, err
+}
+
+func (e *Encoder) node(w *countingWriter, l Level, i Nodes) error {
+	if l == 0 {
+		off, size := rangeBytes(e.length, i, i+1)
+		leaf := make([]byte, size)
+		n, err := e.r.ReadAt(leaf, off)
+		if int64(n) != size {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		w.Write(leaf)
+		return nil
+	}
+	if !hasRightChild(e.leafs, l, i) {
+		return e.node(w, l-1, i*2)
+	}
+	hs := make([]byte, 2*HashSize)
+	_, err := e.tree.ReadAt(hs, HashPosition(e.leafs, l-1, i*2))
+	if err != nil {
+		return err
+	}
+	w.Write(hs)
+	err = e.node(w, l-1, i*2)
+	if err != nil {
+		return err
+	}
+	return e.node(w, l-1, i*2+1)
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
+
+type streamNode struct {
+	l    Level
+	i    Nodes
+	hash *H256
+}
+
+//Decoder reads the combined stream, and returns data only after it is
+//verified. A *CorruptionError is returned at the first bad leaf.
+type Decoder struct {
+	r      io.Reader
+	length int64
+	leafs  Nodes
+	root   *H256
+	stack  []streamNode //nodes yet to be read, next on top
+	leaf   []byte       //verified data not yet returned
+	err    error
+}
+
+//NewDecoder creates a Decoder reading the combined stream from r, of the data
+//identified by root and length.
+func NewDecoder(r io.Reader, root []byte, length int64) *Decoder {
+	return &Decoder{r: r, length: length, leafs: I.Nodes(length), root: FromBytes(root)}
+}
+
+func (d *Decoder) readFull(p []byte) error {
+	_, err := io.ReadFull(d.r, p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (d *Decoder) start() error {
+	header := make([]byte, streamHeaderSize)
+	err := d.readFull(header)
+	if err != nil {
+		return err
+	}
+	length := int64(binary.LittleEndian.Uint64(header))
+	if length != d.length {
+		return fmt.Errorf("hashtree: stream length %v, expected %v", length, d.length)
+	}
+	d.stack = append(d.stack, streamNode{Levels(d.leafs) - 1, 0, d.root})
+	return nil
+}
+
+//next reads and verifies the next leaf.
+func (d *Decoder) next() error {
+	for len(d.stack) > 0 {
+		top := len(d.stack) - 1
+		n := d.stack[top]
+		d.stack = d.stack[:top]
+		if n.l == 0 {
+			_, size := rangeBytes(d.length, n.i, n.i+1)
+			leaf := make([]byte, size)
+			err := d.readFull(leaf)
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(leaf)
+			if *FromBytes(sum[:]) != *n.hash {
+				return &CorruptionError{n.i}
+			}
+			d.leaf = leaf
+			return nil
+		}
+		if !hasRightChild(d.leafs, n.l, n.i) {
+			d.stack = append(d.stack, streamNode{n.l - 1, n.i * 2, n.hash})
+			continue
+		}
+		hs := make([]byte, 2*HashSize)
+		err := d.readFull(hs)
+		if err != nil {
+			return err
+		}
+		left, right := FromBytes(hs), FromBytes(hs[HashSize:])
+		if *innerCompressor(left, right) != *n.hash {
+			first, _ := nodeLeafs(d.leafs, n.l, n.i)
+			return &CorruptionError{first}
+		}
+		d.stack = append(d.stack,
+			streamNode{n.l - 1, n.i*2 + 1, right},
+			streamNode{n.l - 1, n.i * 2, left})
+	}
+	return io.EOF
+}
+
+//Read reads verified data.
+func (d *Decoder) Read(p []byte) (n int, err error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if d.stack == nil {
+		d.err = d.start()
+		if d.err != nil {
+			return 0, d.err
+		}
+	}
+	for len(d.leaf) == 0 {
+		d.err = d.next()
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.length == 0 {
+			d.err = io.EOF
+			return 0, d.err
+		}
+	}
+	n = copy(p, d.leaf)
+	d.leaf = d.leaf[n:]
+	return n, nil
+}
@@ -0,0 +1,91 @@
+package hashtree
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func encodeForTest(t *testing.T, data []byte) (stream, root []byte) {
+	length := int64(len(data))
+	e, err := NewEncoder(bytes.NewReader(data), length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	n, err := e.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) || n != EncodedLength(length) {
+		t.Fatalf("length %v: wrote %v, buffered %v, expected %v", length, n, buf.Len(), EncodedLength(length))
+	}
+	d := NewFile()
+	d.Write(data)
+	return buf.Bytes(), d.Sum(nil)
+}
+
+func TestStreamEncoding(t *testing.T) {
+	for _, length := range rangeProofLengths {
+		data := randomData(length, length)
+		stream, root := encodeForTest(t, data)
+		got, err := ioutil.ReadAll(NewDecoder(bytes.NewReader(stream), root, length))
+		if err != nil {
+			t.Fatalf("length %v: %v", length, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("length %v: decoded data mismatch", length)
+		}
+	}
+}
+
+func TestStreamEncodingCorruption(t *testing.T) {
+	length := int64(13*1024 + 7)
+	data := randomData(length, 4)
+	stream, root := encodeForTest(t, data)
+
+	//flip a byte in the last leaf, which is at the end of the stream
+	bad := append([]byte(nil), stream...)
+	bad[len(bad)-1]++
+	got, err := ioutil.ReadAll(NewDecoder(bytes.NewReader(bad), root, length))
+	ce, ok := err.(*CorruptionError)
+	if !ok || ce.Leaf != 13 {
+		t.Fatalf("expect corruption at leaf 13, got %v", err)
+	}
+	if !bytes.Equal(got, data[:13*1024]) {
+		t.Fatal("data before the bad leaf should be returned")
+	}
+
+	//flip a byte in the first hash after the header
+	bad = append([]byte(nil), stream...)
+	bad[streamHeaderSize]++
+	_, err = ioutil.ReadAll(NewDecoder(bytes.NewReader(bad), root, length))
+	if _, ok := err.(*CorruptionError); !ok {
+		t.Fatalf("expect corruption, got %v", err)
+	}
+
+	_, err = ioutil.ReadAll(NewDecoder(bytes.NewReader(stream[:len(stream)-1]), root, length))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("expect unexpected EOF, got %v", err)
+	}
+
+	_, err = ioutil.ReadAll(NewDecoder(bytes.NewReader(stream), root, length+1))
+	if err == nil {
+		t.Fatal("expect length mismatch")
+	}
+}
+
+func TestStreamEncodingShortRead(t *testing.T) {
+	data := randomData(1<<20+5000, 2)
+	length := int64(len(data))
+	tree, err := TreeListing(bytes.NewReader(data), length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEncoderWithTree(shortReader{bytes.NewReader(data)}, length, bytes.NewReader(tree))
+	_, err = e.WriteTo(ioutil.Discard)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("short read got: %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package hashtree
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+//SuiteID identifies the hash functions used to build a tree. It is sent and
+//stored along with the root hash, so that hashes from different suites are
+//never confused.
+type SuiteID int32
+
+const (
+	//SuiteSHA256 is the original suite, used by NewFile: sha256 leafs and
+	//inner nodes using sha256 compression with sha224's initial hash values.
+	//It is 0, so that ids without a suite are read as this suite.
+	SuiteSHA256 SuiteID = 0
+	//SuiteBLAKE2b uses blake2b-256 for leafs, and blake2b-256 keyed with
+	//blake2bInnerKey for inner nodes.
+	SuiteBLAKE2b SuiteID = 1
+)
+
+//Suite is a named set of hash functions that makes a hash tree.
+type Suite struct {
+	ID   SuiteID
+	Name string
+	//NewLeaf creates the hash of leaf nodes, it must have a Size of HashSize.
+	NewLeaf func() hash.Hash
+	//Compressor merges 2 hashes of child nodes to the hash of the parent.
+	Compressor func(l, r *H256) *H256
+}
+
+//NewFile creates a file tree hash using leaf blocks of LeafBlockSize and the
+//hash functions of the suite.
+func (s *Suite) NewFile() HashTree {
+	return NewFile2(LeafBlockSize, s.NewLeaf(), NewTree2(NoPad32bytes, s.Compressor))
+}
+
+var suites = make(map[SuiteID]*Suite)
+
+//RegisterSuite makes a suite available by it's ID and name.
+//It panics if the ID or name is already used.
+func RegisterSuite(s *Suite) {
+	for _, old := range suites {
+		if old.ID == s.ID || old.Name == s.Name {
+			panic(fmt.Errorf("hashtree: suite %v (%v) already registered", s.ID, s.Name))
+		}
+	}
+	suites[s.ID] = s
+}
+
+//GetSuite returns the registered suite of id.
+func GetSuite(id SuiteID) (*Suite, error) {
+	s, ok := suites[id]
+	if !ok {
+		return nil, fmt.Errorf("hashtree: unknown suite %v", id)
+	}
+	return s, nil
+}
+
+//GetSuiteByName returns the registered suite with name.
+func GetSuiteByName(name string) (*Suite, error) {
+	for _, s := range suites {
+		if s.Name == name {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("hashtree: unknown suite %v", name)
+}
+
+//NewSuiteFile is NewFile using the hash functions of suite id.
+func NewSuiteFile(id SuiteID) (HashTree, error) {
+	s, err := GetSuite(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.NewFile(), nil
+}
+
+var blake2bInnerKey = []byte("fensan-blake2b-tree-v1 inner node")
+
+func newBlake2b256() hash.Hash {
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+func blake2bCompressor(left, right *H256) *H256 {
+	h, err := blake2b.New256(blake2bInnerKey)
+	if err != nil {
+		panic(err)
+	}
+	h.Write(left.ToBytes())
+	h.Write(right.ToBytes())
+	return FromBytes(h.Sum(nil))
+}
+
+func init() {
+	RegisterSuite(&Suite{SuiteSHA256, "fensan-sha256-tree-v1", sha256.New, innerCompressor})
+	RegisterSuite(&Suite{SuiteBLAKE2b, "fensan-blake2b-tree-v1", newBlake2b256, blake2bCompressor})
+}
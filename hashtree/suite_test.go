@@ -0,0 +1,88 @@
+package hashtree
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+func TestSuites(t *testing.T) {
+	data := randomData(5*1024+1, 10)
+	d := NewFile()
+	d.Write(data)
+	expect := d.Sum(nil)
+
+	sha, err := NewSuiteFile(SuiteSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha.Write(data)
+	if !bytes.Equal(sha.Sum(nil), expect) {
+		t.Fatal("default suite should be the same as NewFile")
+	}
+
+	b2, err := NewSuiteFile(SuiteBLAKE2b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2.Write(data)
+	if bytes.Equal(b2.Sum(nil), expect) {
+		t.Fatal("suites should not make the same hash")
+	}
+	b2.Reset()
+	b2.Write(data[:100])
+	leaf := blake2b.Sum256(data[:100])
+	if !bytes.Equal(b2.Sum(nil), leaf[:]) {
+		t.Fatal("a single leaf should hash to blake2b-256")
+	}
+}
+
+func TestSuiteRangeProof(t *testing.T) {
+	s, _ := GetSuite(SuiteBLAKE2b)
+	length := int64(20*1024 + 5)
+	data := randomData(length, 11)
+	tree, err := s.TreeListing(bytes.NewReader(data), length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := tree[len(tree)-HashSize:]
+	d := s.NewFile()
+	d.Write(data)
+	if !bytes.Equal(d.Sum(nil), root) {
+		t.Fatal("listing root is not the suite's root")
+	}
+	proof, err := ProveRange(bytes.NewReader(tree), length, 3, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part := data[3*LeafBlockSize : 7*LeafBlockSize]
+	if err = s.VerifyRange(root, length, proof, part); err != nil {
+		t.Fatal(err)
+	}
+	if VerifyRange(root, length, proof, part) == nil {
+		t.Fatal("verified by the wrong suite")
+	}
+	v := s.NewVerifyingReaderAt(bytes.NewReader(data), root, length, treeFetcher(tree, I.Nodes(length)))
+	p := make([]byte, 5000)
+	if _, err = v.ReadAt(p, 3000); err != nil || !bytes.Equal(p, data[3000:8000]) {
+		t.Fatal("suite reader:", err)
+	}
+}
+
+func TestSuiteRegistry(t *testing.T) {
+	s, err := GetSuiteByName("fensan-sha256-tree-v1")
+	if err != nil || s.ID != SuiteSHA256 {
+		t.Fatal(s, err)
+	}
+	_, err = GetSuite(-1)
+	if err == nil {
+		t.Fatal("unknown suite found")
+	}
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("registering the same id should panic")
+		}
+	}()
+	RegisterSuite(&Suite{SuiteBLAKE2b, "other", nil, nil})
+}
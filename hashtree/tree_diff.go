@@ -0,0 +1,100 @@
+package hashtree
+
+import "bytes"
+
+//LeafRange is the range of leafs from From to To-1.
+type LeafRange struct {
+	From Nodes
+	To   Nodes
+}
+
+//DiffTrees walks the trees of two files top-down, and returns the ranges of
+//leafs that differ, in order and merged when adjacent.
+//
+//The hashes of each tree are read with a and b, for files of aLength and
+//bLength bytes. Levels lower than minLevel are never read, changes found at
+//minLevel are reported as the full range of the node. Use 0 when all levels
+//are available.
+//
+//Nodes are only compared when they cover the same full leafs in both files,
+//leafs that exist in only one file are always reported as different.
+func DiffTrees(a HashFetcher, aLength int64, b HashFetcher, bLength int64, minLevel Level) ([]LeafRange, error) {
+	w := &treeDiffer{a: a, b: b, aLength: aLength, bLength: bLength, minLevel: minLevel}
+	aLeafs, bLeafs := I.Nodes(aLength), I.Nodes(bLength)
+	w.minLeafs, w.maxLeafs = aLeafs, bLeafs
+	if w.minLeafs > w.maxLeafs {
+		w.minLeafs, w.maxLeafs = w.maxLeafs, w.minLeafs
+	}
+	w.common = aLength
+	if bLength < w.common {
+		w.common = bLength
+	}
+	err := w.node(Levels(w.maxLeafs)-1, 0)
+	return w.diff, err
+}
+
+type treeDiffer struct {
+	a, b               HashFetcher
+	aLength, bLength   int64
+	minLevel           Level
+	minLeafs, maxLeafs Nodes
+	common             int64 //bytes in both files
+	diff               []LeafRange
+}
+
+func (w *treeDiffer) report(from, to Nodes) {
+	if to > w.maxLeafs {
+		to = w.maxLeafs
+	}
+	last := len(w.diff) - 1
+	if last >= 0 && w.diff[last].To == from {
+		w.diff[last].To = to
+		return
+	}
+	w.diff = append(w.diff, LeafRange{from, to})
+}
+
+//comparable reports if the node at l, i covers the same data in both files.
+func (w *treeDiffer) comparable(l Level, i Nodes) bool {
+	if w.aLength == w.bLength {
+		return true
+	}
+	end := int64(i+1) << uint(l) * LeafBlockSize
+	return end <= w.common
+}
+
+func (w *treeDiffer) node(l Level, i Nodes) error {
+	from := i << uint(l)
+	to := (i + 1) << uint(l)
+	if from >= w.maxLeafs {
+		return nil
+	}
+	if from >= w.minLeafs {
+		w.report(from, to)
+		return nil
+	}
+	if w.comparable(l, i) {
+		ah := make([]byte, HashSize)
+		bh := make([]byte, HashSize)
+		err := w.a(ah, l, i)
+		if err != nil {
+			return err
+		}
+		err = w.b(bh, l, i)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(ah, bh) {
+			return nil
+		}
+	}
+	if l <= w.minLevel {
+		w.report(from, to)
+		return nil
+	}
+	err := w.node(l-1, i*2)
+	if err != nil {
+		return err
+	}
+	return w.node(l-1, i*2+1)
+}
@@ -0,0 +1,88 @@
+package hashtree
+
+import (
+	"bytes"
+	"testing"
+)
+
+//bruteDiff compares leaf by leaf
+func bruteDiff(a, b []byte) []bool {
+	common := len(a)
+	if len(b) < common {
+		common = len(b)
+	}
+	leafs := I.Nodes(int64(len(a)))
+	if bl := I.Nodes(int64(len(b))); bl > leafs {
+		leafs = bl
+	}
+	diff := make([]bool, leafs)
+	for k := range diff {
+		s, e := k*LeafBlockSize, (k+1)*LeafBlockSize
+		if len(a) != len(b) && e > common {
+			diff[k] = true
+		} else {
+			if e > common {
+				e = common
+			}
+			diff[k] = !bytes.Equal(a[s:e], b[s:e])
+		}
+	}
+	return diff
+}
+
+func testDiff(t *testing.T, a, b []byte, minLevel Level) {
+	at, _ := TreeListing(bytes.NewReader(a), int64(len(a)))
+	bt, _ := TreeListing(bytes.NewReader(b), int64(len(b)))
+	al, bl := int64(len(a)), int64(len(b))
+	ranges, err := DiffTrees(treeFetcher(at, I.Nodes(al)), al, treeFetcher(bt, I.Nodes(bl)), bl, minLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := bruteDiff(a, b)
+	got := make([]bool, len(expect))
+	last := Nodes(-1)
+	for _, r := range ranges {
+		if r.From <= last || r.From >= r.To {
+			t.Fatalf("ranges not in order or not merged: %v", ranges)
+		}
+		last = r.To
+		for k := r.From; k < r.To; k++ {
+			got[k] = true
+		}
+	}
+	for k := range expect {
+		if expect[k] && !got[k] {
+			t.Fatalf("lengths %v, %v: leaf %v not reported in %v", al, bl, k, ranges)
+		}
+		if minLevel == 0 && got[k] && !expect[k] {
+			t.Fatalf("lengths %v, %v: leaf %v wrongly reported in %v", al, bl, k, ranges)
+		}
+	}
+}
+
+func TestDiffTrees(t *testing.T) {
+	a := randomData(20*1024, 8)
+	b := append([]byte(nil), a...)
+	b[0]++
+	b[5*1024+3]++
+	b[6*1024]++
+	b[19*1024+1000]++
+	for _, minLevel := range []Level{0, 2} {
+		testDiff(t, a, a, minLevel)
+		testDiff(t, a, b, minLevel)
+		testDiff(t, a[:17*1024], b, minLevel)
+		testDiff(t, a[:17*1024+5], b, minLevel)
+		testDiff(t, a, b[:3000], minLevel)
+		testDiff(t, a[:0], b[:1], minLevel)
+	}
+}
+
+func TestDiffTreesSame(t *testing.T) {
+	a := randomData(9*1024, 9)
+	at, _ := TreeListing(bytes.NewReader(a), int64(len(a)))
+	f := treeFetcher(at, I.Nodes(int64(len(a))))
+	ranges, err := DiffTrees(f, int64(len(a)), f, int64(len(a)), 0)
+	if err != nil || len(ranges) != 0 {
+		t.Fatal(ranges, err)
+	}
+}
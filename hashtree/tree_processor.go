@@ -78,11 +78,11 @@ type treeDigest struct {
 }
 
 func NewTree() CopyableHashTree {
-	return NewTree2(ZeroPad32bytes, ht_sha256block)
+	return NewTree2(ZeroPad32bytes, innerCompressor)
 }
 
 func NewNoPadTree() CopyableHashTree {
-	return NewTree2(NoPad32bytes, ht_sha256block)
+	return NewTree2(NoPad32bytes, innerCompressor)
 }
 
 // Create a binary tree hash using padder and compressor.
@@ -127,6 +127,8 @@ func (d *treeDigest) Reset() {
 	d.xn = 0
 	d.len = 0
 	d.stack = [64]*H256{nil}
+	d.sn = 0
+	d.innersCounter = [MaxLevel]Nodes{}
 }
 func (d *treeDigest) Write(p []byte) (startLength int, err error) {
 	startLength = len(p)
@@ -34,7 +34,7 @@ func highBitMask(n uint32) uint32 {
 
 func highBitMask64(n uint64) uint64 {
 	if n >= 1<<32 {
-		return uint64(highBitMask(uint32(n>>32)) << 32)
+		return uint64(highBitMask(uint32(n>>32))) << 32
 	} else {
 		return uint64(highBitMask(uint32(n)))
 	}
@@ -106,20 +106,25 @@ func SplitLength(b int64) (l, r int64) {
 //Split inner hashes based on highest derivable ancestors
 func SplitLocalSummable(hashes []byte, hashSize int, levelWidth Nodes, off Nodes) [][]byte {
 	length := Nodes(len(hashes) / hashSize)
-	from := off
-	to := from + length - 1
-	ranges := slsUntrusted(from, to, levelWidth)
+	ranges := LocalSummableRanges(off, off+length-1, levelWidth)
 	if ranges == nil {
 		return nil
 	}
 	return split(hashes, hashSize, off, ranges)
 }
 
+//LocalSummableRanges returns the ranges (from and to inclusive) of nodes from
+//from to to on a level of width, that each sum up to a single ancestor.
+//Nodes that can't are left out, nil is returned if from or to is out of range.
+func LocalSummableRanges(from, to, width Nodes) [][2]Nodes {
+	return slsUntrusted(from, to, width)
+}
+
 func split(b []byte, hashSize int, off Nodes, ranges [][2]Nodes) [][]byte {
 	r := make([][]byte, len(ranges))
 	for i, v := range ranges {
-		fb := int((v[0] + off)) * hashSize
-		tb := int((v[1] + off)) * hashSize
+		fb := int(v[0]-off) * hashSize
+		tb := int(v[1]-off+1) * hashSize
 		r[i] = b[fb:tb]
 	}
 	return r
@@ -0,0 +1,210 @@
+package hashtree
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+//HashFetcher reads the hashes of a tree at level, from index off, into hs.
+//len(hs) is a multiple of HashSize.
+//Such as MetaStore.GetInnerHashes with the key filled in.
+type HashFetcher func(hs []byte, level Level, off Nodes) error
+
+//CorruptionError is reported when data does not match the tree.
+type CorruptionError struct {
+	Leaf Nodes //the first leaf that failed verification
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("hashtree: data corrupted at leaf %v", e.Leaf)
+}
+
+//verifiedMinLevel is the lowest level of verified hashes kept by
+//VerifyingReaderAt, so that memory used is at most one hash per 16 leafs.
+const verifiedMinLevel = 4
+
+type nodeIndex struct {
+	l Level
+	i Nodes
+}
+
+//VerifyingReaderAt reads from an untrusted io.ReaderAt, and only returns data
+//after it is verified against the root hash.
+//
+//Hashes needed for verification are taken from those given by PutHashes, or
+//read from the HashFetcher. Verified hashes are kept to shorten later
+//verifications.
+type VerifyingReaderAt struct {
+	suite    *Suite
+	r        io.ReaderAt
+	length   int64
+	leafs    Nodes
+	fetch    HashFetcher
+	mu       sync.Mutex
+	verified map[nodeIndex]*H256
+	pending  map[nodeIndex]*H256 //untrusted hashes from PutHashes
+}
+
+//NewVerifyingReaderAt is Suite.NewVerifyingReaderAt of SuiteSHA256.
+func NewVerifyingReaderAt(r io.ReaderAt, root []byte, length int64, fetch HashFetcher) *VerifyingReaderAt {
+	return suites[SuiteSHA256].NewVerifyingReaderAt(r, root, length, fetch)
+}
+
+//NewVerifyingReaderAt creates a VerifyingReaderAt of data in r identified by
+//root and length, hashed by s. fetch is used to get hashes not already given
+//by PutHashes, it can be nil.
+func (s *Suite) NewVerifyingReaderAt(r io.ReaderAt, root []byte, length int64, fetch HashFetcher) *VerifyingReaderAt {
+	leafs := I.Nodes(length)
+	v := &VerifyingReaderAt{
+		suite:    s,
+		r:        r,
+		length:   length,
+		leafs:    leafs,
+		fetch:    fetch,
+		verified: make(map[nodeIndex]*H256),
+		pending:  make(map[nodeIndex]*H256),
+	}
+	v.verified[nodeIndex{Levels(leafs) - 1, 0}] = FromBytes(root)
+	return v
+}
+
+//Size returns the length of the data in bytes.
+func (v *VerifyingReaderAt) Size() int64 { return v.length }
+
+//PutHashes gives hashes at level from index off, that maybe needed later.
+//The hashes are not trusted until they are used in a verification.
+func (v *VerifyingReaderAt) PutHashes(hs []byte, level Level, off Nodes) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for ; len(hs) >= HashSize; hs = hs[HashSize:] {
+		v.pending[nodeIndex{level, off}] = FromBytes(hs)
+		off++
+	}
+}
+
+//ReadAt reads len(p) bytes from offset off, after verifying all leafs covering
+//them. A *CorruptionError is returned if the data is not verified.
+func (v *VerifyingReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, fmt.Errorf("hashtree: negative offset %v", off)
+	}
+	if off >= v.length {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	end := off + int64(len(p))
+	if end > v.length {
+		end = v.length
+		err = io.EOF
+	}
+	from := Nodes(off / LeafBlockSize)
+	to := Nodes((end + LeafBlockSize - 1) / LeafBlockSize)
+	start, size := rangeBytes(v.length, from, to)
+	buf := make([]byte, size)
+	rn, rerr := v.r.ReadAt(buf, start)
+	if rn != len(buf) {
+		if rerr == nil || rerr == io.EOF {
+			rerr = io.ErrUnexpectedEOF //shorter than length
+		}
+		return 0, rerr
+	}
+	verr := v.verify(from, to, buf)
+	if verr != nil {
+		return 0, verr
+	}
+	return copy(p, buf[off-start:end-start]), err
+}
+
+func (v *VerifyingReaderAt) verify(from, to Nodes, data []byte) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	used, err := v.verifyLocked(from, to, data)
+	if err != nil {
+		if _, ok := err.(*CorruptionError); ok {
+			if to-from > 1 {
+				err = v.locateCorruption(from, to, data)
+			}
+			for _, n := range used {
+				delete(v.pending, n)
+			}
+		}
+	}
+	return err
+}
+
+//locateCorruption finds the first leaf from to to-1 that fails.
+func (v *VerifyingReaderAt) locateCorruption(from, to Nodes, data []byte) error {
+	for k := from; k < to; k++ {
+		start, _ := rangeBytes(v.length, from, k)
+		off, size := rangeBytes(v.length, k, k+1)
+		_, err := v.verifyLocked(k, k+1, data[off-start:off-start+size])
+		if err != nil {
+			return err //a failed fetch is not a corruption
+		}
+	}
+	return &CorruptionError{from}
+}
+
+//verifyLocked verifies data of leafs from to to-1 against the lowest verified
+//node covering them, it returns pending hashes used.
+func (v *VerifyingReaderAt) verifyLocked(from, to Nodes, data []byte) (used []nodeIndex, err error) {
+	l, i := Levels(v.leafs)-1, Nodes(0)
+	top := v.verified[nodeIndex{l, i}]
+	for l > 0 {
+		c := from >> uint(l-1)
+		if c != (to-1)>>uint(l-1) {
+			break
+		}
+		h, ok := v.verified[nodeIndex{l - 1, c}]
+		if !ok {
+			break
+		}
+		l, i, top = l-1, c, h
+	}
+
+	computed := make(map[nodeIndex]*H256)
+	rv := &rangeVerifier{suite: v.suite, leafs: v.leafs, length: v.length, from: from, to: to, data: data}
+	rv.sibling = func(l Level, i Nodes) (*H256, error) {
+		n := nodeIndex{l, i}
+		h, ok := v.verified[n]
+		if !ok {
+			h, ok = v.pending[n]
+			if ok {
+				used = append(used, n)
+			} else if v.fetch != nil {
+				hs := make([]byte, HashSize)
+				err := v.fetch(hs, l, i)
+				if err != nil {
+					return nil, err
+				}
+				h = FromBytes(hs)
+			} else {
+				return nil, fmt.Errorf("hashtree: missing hash at level %v, index %v", l, i)
+			}
+			computed[n] = h
+		}
+		return h, nil
+	}
+	rv.listener = func(l Level, i Nodes, h *H256) {
+		computed[nodeIndex{l, i}] = h
+	}
+	h, err := rv.node(l, i)
+	if err != nil {
+		return used, err
+	}
+	if *h != *top {
+		return used, &CorruptionError{from}
+	}
+	for n, h := range computed {
+		if n.l >= verifiedMinLevel {
+			v.verified[n] = h
+		}
+	}
+	for _, n := range used {
+		delete(v.pending, n)
+	}
+	return nil, nil
+}
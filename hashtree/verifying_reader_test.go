@@ -0,0 +1,119 @@
+package hashtree
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func treeFetcher(tree []byte, leafs Nodes) HashFetcher {
+	return func(hs []byte, level Level, off Nodes) error {
+		copy(hs, tree[HashPosition(leafs, level, off):])
+		return nil
+	}
+}
+
+func TestVerifyingReaderAt(t *testing.T) {
+	length := int64(100*1024 + 5)
+	data := randomData(length, 1)
+	tree, _ := TreeListing(bytes.NewReader(data), length)
+	root := tree[len(tree)-HashSize:]
+	v := NewVerifyingReaderAt(bytes.NewReader(data), root, length, treeFetcher(tree, I.Nodes(length)))
+
+	reads := [][2]int64{{0, 1}, {0, 1024}, {1000, 100}, {5000, 30000}, {length - 3, 3}, {50000, 1}, {0, length}}
+	for _, r := range reads {
+		p := make([]byte, r[1])
+		n, err := v.ReadAt(p, r[0])
+		if err != nil {
+			t.Fatalf("read %v: %v", r, err)
+		}
+		if n != len(p) || !bytes.Equal(p, data[r[0]:r[0]+r[1]]) {
+			t.Fatalf("read %v: wrong data", r)
+		}
+	}
+
+	p := make([]byte, 10)
+	n, err := v.ReadAt(p, length-4)
+	if n != 4 || err != io.EOF {
+		t.Fatalf("read pass end: %v, %v", n, err)
+	}
+	n, err = v.ReadAt(p, length)
+	if n != 0 || err != io.EOF {
+		t.Fatalf("read at end: %v, %v", n, err)
+	}
+}
+
+func TestVerifyingReaderAtCorruption(t *testing.T) {
+	length := int64(20 * 1024)
+	data := randomData(length, 2)
+	tree, _ := TreeListing(bytes.NewReader(data), length)
+	root := tree[len(tree)-HashSize:]
+	bad := append([]byte(nil), data...)
+	bad[7*1024+10]++
+	v := NewVerifyingReaderAt(bytes.NewReader(bad), root, length, treeFetcher(tree, I.Nodes(length)))
+
+	p := make([]byte, 1024)
+	_, err := v.ReadAt(p, 6*1024)
+	if err != nil {
+		t.Fatal("good leaf should read:", err)
+	}
+	p = make([]byte, 5*1024)
+	_, err = v.ReadAt(p, 5*1024)
+	ce, ok := err.(*CorruptionError)
+	if !ok || ce.Leaf != 7 {
+		t.Fatalf("expect corruption at leaf 7, got %v", err)
+	}
+}
+
+func TestVerifyingReaderAtErrors(t *testing.T) {
+	length := int64(20 * 1024)
+	data := randomData(length, 2)
+	tree, _ := TreeListing(bytes.NewReader(data), length)
+	root := tree[len(tree)-HashSize:]
+
+	short := NewVerifyingReaderAt(bytes.NewReader(data[:length-10]), root, length, treeFetcher(tree, I.Nodes(length)))
+	_, err := short.ReadAt(make([]byte, 100), length-100)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatal("short read:", err)
+	}
+
+	bad := append([]byte(nil), data...)
+	bad[7*1024+10]++
+	fetchErr := errors.New("fetch failed")
+	fetch := treeFetcher(tree, I.Nodes(length))
+	v := NewVerifyingReaderAt(bytes.NewReader(bad), root, length, func(hs []byte, level Level, off Nodes) error {
+		if level == 0 {
+			return fetchErr
+		}
+		return fetch(hs, level, off)
+	})
+	_, err = v.ReadAt(make([]byte, 4*1024), 4*1024)
+	if err != fetchErr {
+		t.Fatal("expect the fetch error, got", err)
+	}
+}
+
+func TestVerifyingReaderAtPutHashes(t *testing.T) {
+	length := int64(4 * 1024)
+	data := randomData(length, 3)
+	tree, _ := TreeListing(bytes.NewReader(data), length)
+	leafs := I.Nodes(length)
+	root := tree[len(tree)-HashSize:]
+	v := NewVerifyingReaderAt(bytes.NewReader(data), root, length, nil)
+
+	p := make([]byte, 1024)
+	_, err := v.ReadAt(p, 0)
+	if err == nil {
+		t.Fatal("should not verify without hashes")
+	}
+	v.PutHashes(tree[HashPosition(leafs, 0, 1):HashPosition(leafs, 0, 2)], 0, 1)
+	v.PutHashes(tree[HashPosition(leafs, 1, 1):HashPosition(leafs, 1, 2)], 1, 1)
+	_, err = v.ReadAt(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, data[:1024]) {
+		t.Fatal("wrong data")
+	}
+}
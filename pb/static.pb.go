@@ -49,6 +49,7 @@ var _ = math.Inf
 type StaticId struct {
 	Hash             []byte `protobuf:"bytes,1,req,name=hash" json:"hash"`
 	Length           int64  `protobuf:"varint,2,req,name=length" json:"length"`
+	Algorithm        *int32 `protobuf:"varint,3,opt,name=algorithm" json:"algorithm,omitempty"`
 	XXX_unrecognized []byte `json:"-"`
 }
 
@@ -156,6 +157,23 @@ func (m *StaticId) Unmarshal(data []byte) error {
 					break
 				}
 			}
+		case 3:
+			if wireType != 0 {
+				return code_google_com_p_gogoprotobuf_proto.ErrWrongType
+			}
+			var v int32
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Algorithm = &v
 		default:
 			var sizeOfWire int
 			for {
@@ -659,6 +677,7 @@ func (this *StaticId) String() string {
 	s := strings.Join([]string{`&StaticId{`,
 		`Hash:` + fmt.Sprintf("%v", this.Hash) + `,`,
 		`Length:` + fmt.Sprintf("%v", this.Length) + `,`,
+		`Algorithm:` + valueToStringStatic(this.Algorithm) + `,`,
 		`XXX_unrecognized:` + fmt.Sprintf("%v", this.XXX_unrecognized) + `,`,
 		`}`,
 	}, "")
@@ -733,6 +752,9 @@ func (m *StaticId) Size() (n int) {
 	l = len(m.Hash)
 	n += 1 + l + sovStatic(uint64(l))
 	n += 1 + sovStatic(uint64(m.Length))
+	if m.Algorithm != nil {
+		n += 1 + sovStatic(uint64(uint32(*m.Algorithm)))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -861,6 +883,11 @@ func (m *StaticId) MarshalTo(data []byte) (n int, err error) {
 	data[i] = 0x10
 	i++
 	i = encodeVarintStatic(data, i, uint64(m.Length))
+	if m.Algorithm != nil {
+		data[i] = 0x18
+		i++
+		i = encodeVarintStatic(data, i, uint64(uint32(*m.Algorithm)))
+	}
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
@@ -1096,7 +1123,7 @@ func (this *StaticId) GoString() string {
 	if this == nil {
 		return "nil"
 	}
-	s := strings1.Join([]string{`&pb.StaticId{` + `Hash:` + fmt1.Sprintf("%#v", this.Hash), `Length:` + fmt1.Sprintf("%#v", this.Length), `XXX_unrecognized:` + fmt1.Sprintf("%#v", this.XXX_unrecognized) + `}`}, ", ")
+	s := strings1.Join([]string{`&pb.StaticId{` + `Hash:` + fmt1.Sprintf("%#v", this.Hash), `Length:` + fmt1.Sprintf("%#v", this.Length), `Algorithm:` + valueToGoStringStatic(this.Algorithm, "int32"), `XXX_unrecognized:` + fmt1.Sprintf("%#v", this.XXX_unrecognized) + `}`}, ", ")
 	return s
 }
 func (this *InnerHashes) GoString() string {
@@ -1157,6 +1184,7 @@ type StaticIdFace interface {
 	Proto() code_google_com_p_gogoprotobuf_proto2.Message
 	GetHash() []byte
 	GetLength() int64
+	GetAlgorithm() *int32
 }
 
 func (this *StaticId) Proto() code_google_com_p_gogoprotobuf_proto2.Message {
@@ -1175,10 +1203,15 @@ func (this *StaticId) GetLength() int64 {
 	return this.Length
 }
 
+func (this *StaticId) GetAlgorithm() *int32 {
+	return this.Algorithm
+}
+
 func NewStaticIdFromFace(that StaticIdFace) *StaticId {
 	this := &StaticId{}
 	this.Hash = that.GetHash()
 	this.Length = that.GetLength()
+	this.Algorithm = that.GetAlgorithm()
 	return this
 }
 
@@ -1366,6 +1399,15 @@ func (this *StaticId) Equal(that interface{}) bool {
 	if this.Length != that1.Length {
 		return false
 	}
+	if this.Algorithm != nil && that1.Algorithm != nil {
+		if *this.Algorithm != *that1.Algorithm {
+			return false
+		}
+	} else if this.Algorithm != nil {
+		return false
+	} else if that1.Algorithm != nil {
+		return false
+	}
 	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
 		return false
 	}
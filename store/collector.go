@@ -0,0 +1,191 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	ht "github.com/xiegeo/fensan/hashtree"
+)
+
+//Collector removes files and blobs after their TTL ended. It scans the TTL
+//records a slice at a time, so it can run along side normal use, and saves
+//where it is, so a restart continues the scan instead of starting over.
+//
+//Files are removed with their hashes and state. Data blobs are shared, so they
+//have TTL records of their own, kept at least as long as the files using them.
+type Collector struct {
+	mu     sync.Mutex
+	db     *database
+	cursor []byte //last key scanned, nil to start from the first
+	stats  CollectorStats
+}
+
+//CollectorStats reports the progress of a Collector since it was created.
+type CollectorStats struct {
+	Scanned int64 //number of TTL records read
+	Removed int64 //number of expired TTL records removed
+	Failed  int64 //expired TTL records kept as a delete failed, tried again next round
+	Freed   int64 //bytes of blobs deleted
+	Rounds  int64 //number of full scans finished
+	Cursor  []byte
+}
+
+const collectorCursorFile = "/gc_cursor"
+
+//NewCollector creates a Collector for db, which must be from OpenDatabase.
+func NewCollector(db Database) (*Collector, error) {
+	d, ok := db.(*database)
+	if !ok {
+		return nil, fmt.Errorf("collector can't be used on %T", db)
+	}
+	cursor, err := ioutil.ReadFile(d.path + collectorCursorFile)
+	if os.IsNotExist(err) {
+		cursor, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(cursor) == 0 {
+		cursor = nil
+	}
+	c := &Collector{db: d, cursor: cursor}
+	c.stats.Cursor = cursor
+	return c, nil
+}
+
+//Step scans at most max TTL records from where the last Step stopped,
+//done is true when the end is reached, then the next Step starts over.
+//
+//ErrReadOnly is returned without deleting anything after a time skip.
+func (c *Collector) Step(max int) (done bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err = c.db.time.check()
+	if err != nil {
+		return false, err
+	}
+	ttlStore := c.db.ttlStore
+	ttlStore.Sync() //so that GC can see all TTL updates
+	now := c.db.time.now()
+	seen := 0
+	var last []byte
+	ttlStore.GC(c.cursor, func(k []byte, v []byte) (bool, bool) {
+		seen++
+		last = k
+		stop := seen >= max
+		key, ok := hLKeyFromFullBytes(k)
+		if !ok || len(v) != 2 || TTLFromBytes(v) >= now {
+			return false, stop
+		}
+		freed, removed, err := c.db.remove(key, now)
+		c.stats.Freed += freed
+		if err != nil {
+			log.Printf("collector: keeping the TTL of %x: %v", k, err)
+			c.stats.Failed++
+			return false, stop
+		}
+		if !removed {
+			return false, stop
+		}
+		c.stats.Removed++
+		return true, stop
+	})
+	c.db.verifiedStore.Sync()
+	c.stats.Scanned += int64(seen)
+	done = seen < max
+	if done {
+		c.cursor = nil
+		c.stats.Rounds++
+	} else {
+		c.cursor = last
+	}
+	c.stats.Cursor = c.cursor
+	return done, c.saveCursor()
+}
+
+//saveCursor writes the cursor to a new file, then renames it over the old
+//one, so a crash leaves either one.
+func (c *Collector) saveCursor() error {
+	name := c.db.path + collectorCursorFile
+	err := ioutil.WriteFile(name+".new", c.cursor, 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(name+".new", name)
+}
+
+//Run calls Step with slices of max records every interval, until stop is closed.
+//While the database is read only, steps are skipped.
+func (c *Collector) Run(interval time.Duration, max int, stop <-chan struct{}) error {
+	for {
+		_, err := c.Step(max)
+		if err != nil && err != ErrReadOnly {
+			return err
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+//Stats returns the progress so far.
+func (c *Collector) Stats() CollectorStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Cursor = append([]byte(nil), s.Cursor...)
+	return s
+}
+
+//remove deletes everything saved by key except the TTL record, if the TTL is
+//still before now while the file is locked. It returns the bytes of data
+//deleted, and if the file was removed. On an error, some deletes might be
+//done, the TTL record must be kept to try again.
+func (d *database) remove(key HLKey, now TTL) (freed int64, removed bool, err error) {
+	d.fileLocks.lock(key.FullBytes())
+	defer d.fileLocks.unlock(key.FullBytes())
+	d.ttlStore.Sync() //a TTL set before the lock is seen
+	if d.TTLGet(key) >= now {
+		return 0, false, nil //extended since scanned
+	}
+	length := key.GetLength()
+	err = d.deleteHashTree(key)
+	if err != nil {
+		return 0, false, err
+	}
+	_, stateBytes := stateSizes(ht.I.Nodes(length))
+	gone, err := d.stateStore.Delete(key.FullBytes(), stateBytes)
+	if !gone {
+		return 0, false, err
+	}
+	d.verifiedStore.Delete(key.FullBytes())
+	for i := ht.Nodes(0); int64(i)*BlobSize < length; i++ {
+		_, _, _, size := blobRange(length, i)
+		err = d.deletePartTree(key, i)
+		if err != nil {
+			return freed, false, err
+		}
+		gone, err := d.dataStore.Delete(partKey(key, i), size)
+		if err == nil {
+			freed += size
+		} else if !gone {
+			return freed, false, err
+		}
+	}
+	if length > 0 && length <= BlobSize {
+		//the file is a blob
+		gone, err := d.dataStore.Delete(blobKey(key.Suite(), key.GetHash(), length), length)
+		if err == nil {
+			freed += length
+		} else if !gone {
+			return freed, false, err
+		}
+	}
+	return freed, true, nil
+}
@@ -0,0 +1,118 @@
+package store
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestCollector(t *testing.T) {
+	path := ".testCollector"
+	db := openTestDatabase(t, path)
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	now := TTLNow()
+	b := testData(BlobSize+100, 5)
+	d := append(append([]byte(nil), b[:BlobSize]...), testData(200, 6)...)
+	files := map[string][]byte{"a": testData(100, 7), "b": b, "c": testData(300, 8), "d": d}
+	keys := make(map[string]HLKey)
+	for name, data := range files {
+		key, err := db.ImportFromReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[name] = key
+	}
+	db.TTLSetAtleast(keys["a"], now, now-1)
+	db.TTLSetAtleast(keys["b"], now, now-1)
+	db.TTLSetAtleast(keys["c"], now, now+6)
+	db.TTLSetAtleast(keys["d"], now, now+6)
+	if db.GetState(keys["a"]) != FileExpired {
+		t.Fatal("a should be expired")
+	}
+
+	c, err := NewCollector(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, err := c.Step(2)
+	if done || err != nil {
+		t.Fatal(done, err)
+	}
+	//restart from the saved cursor
+	c, err = NewCollector(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := c.Stats(); len(s.Cursor) == 0 {
+		t.Fatal("cursor not saved")
+	}
+	for !done {
+		done, err = c.Step(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := c.Stats()
+	//8 records: 4 files, 3 blobs of b and d, and ttlEpochKey
+	if s.Scanned != 8-2 || s.Removed != 2+1 || s.Freed != 100+100 || s.Rounds != 1 || s.Cursor != nil {
+		t.Fatalf("%+v", s)
+	}
+	for name, expect := range map[string]FileState{"a": FileNone, "b": FileNone, "c": FileComplete, "d": FileComplete} {
+		if got := db.GetState(keys[name]); got != expect {
+			t.Fatalf("%v is %v, expect %v", name, got, expect)
+		}
+	}
+	got := make([]byte, len(d))
+	err = db.GetAt(keys["d"], got, 0)
+	if err != nil || !bytes.Equal(got, d) {
+		t.Fatal("shared blob removed", err)
+	}
+}
+
+func TestCollectorKeepTTL(t *testing.T) {
+	path := ".testCollectorKeepTTL"
+	db := openTestDatabase(t, path)
+	defer os.RemoveAll(path)
+	defer db.Close()
+	d := db.(*database)
+
+	now := TTLNow()
+	key, err := db.ImportFromReader(bytes.NewReader(testData(100, 7)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.TTLSetAtleast(key, now, now-1)
+
+	//extended after it was scanned
+	db.TTLSetAtleast(key, now, now+1)
+	_, removed, err := d.remove(key, now)
+	if removed || err != nil || db.GetState(key) != FileComplete {
+		t.Fatal("extended file removed", err)
+	}
+
+	//a delete that fails, as the state is open
+	key, err = db.ImportFromReader(bytes.NewReader(testData(200, 7)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.TTLSetAtleast(key, now, now-1)
+	s, err := d.openState(key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCollector(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Step(10)
+	if st := c.Stats(); st.Failed != 1 || st.Removed != 0 || db.TTLGet(key) != now-1 {
+		t.Fatalf("TTL not kept %+v", st)
+	}
+	s.Close()
+	c.Step(10)
+	if st := c.Stats(); st.Removed != 1 || db.GetState(key) != FileNone {
+		t.Fatalf("not removed again %+v", st)
+	}
+}
@@ -0,0 +1,815 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/xiegeo/fensan/bitset"
+	ht "github.com/xiegeo/fensan/hashtree"
+)
+
+//database is a Database that keeps file data in blobs of BlobSize.
+//
+//Each blob is a subtree of the file at InnerHashMinLevel, it is verified with
+//the hash of that subtree from the meta store. Verified blobs are saved by their
+//own hash, so files with the same blobs share them. Blobs still in download are
+//kept under the file key and blob index, until all of it is written and
+//verified. Leafs are verified as they are written when the hashes below the
+//blob are known, see putPartHashes.
+//
+//Calls on a file are serialized by the lock of its key.
+type database struct {
+	*metaStore
+	path          string
+	time          *timeGuard
+	dataStore     LVE       //data blobs, by blobKey or partKey
+	stateStore    *folderLV //fileState of each file, by FullBytes of file key
+	stateJournal  *journal  //of stateStore
+	verifiedStore KV        //unix time of the last good scrub, by FullBytes of file key
+	fileLocks     keyLocks  //by FullBytes of file key
+}
+
+//blobLeafs is the number of leafs in a full blob.
+const blobLeafs = BlobSize / ht.LeafBlockSize
+
+//OpenDatabase opens the database at path, with DefaultMaxTimeSkip.
+func OpenDatabase(path string) (Database, error) {
+	return OpenDatabaseMaxSkip(path, DefaultMaxTimeSkip)
+}
+
+//OpenDatabaseMaxSkip opens the database at path. If TTLNow moves forward by
+//more than maxSkip months from the last time seen, now or while running, the
+//database turns read only until ConfirmTime is called.
+func OpenDatabaseMaxSkip(path string, maxSkip int16) (Database, error) {
+	d, err := openDatabase(path, maxSkip, TTLNow)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+//openDatabase opens the database at path, with now as the clock.
+func openDatabase(path string, maxSkip int16, now func() TTL) (*database, error) {
+	m, err := openMetaStore(path)
+	if err != nil {
+		return nil, err
+	}
+	g, err := openTimeGuard(path, maxSkip, now)
+	if err != nil && err != ErrReadOnly {
+		m.Close()
+		return nil, err
+	}
+	verifiedStore, err := OpenLeveldb(path + "/d_verified")
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	dataStore, err := OpenFolderLVE(path + "/d_data")
+	if err != nil {
+		m.Close()
+		verifiedStore.Close()
+		return nil, err
+	}
+	stateStore, err := openFolderLV(path+"/d_state", true)
+	if err != nil {
+		m.Close()
+		verifiedStore.Close()
+		dataStore.Close()
+		return nil, err
+	}
+	stateJournal, err := openJournal(path+"/d_journal", stateStore)
+	if err != nil {
+		m.Close()
+		verifiedStore.Close()
+		dataStore.Close()
+		stateStore.Close()
+		return nil, err
+	}
+	return &database{
+		metaStore:     m,
+		path:          path,
+		time:          g,
+		dataStore:     dataStore,
+		stateStore:    stateStore,
+		stateJournal:  stateJournal,
+		verifiedStore: verifiedStore,
+	}, nil
+}
+
+//fileState tracks the leafs of a file that are received and verified. I/O
+//errors are kept by mixed, and returned by Close.
+type fileState struct {
+	have     *bitset.CountingBitSet   //leafs verified
+	received *bitset.BlobBackedBitSet //leafs written to blobs not yet verified
+	mixed    *journalBlob
+}
+
+func stateSizes(leafs ht.Nodes) (haveBytes, stateBytes int64) {
+	haveBytes = (int64(leafs)+7)/8 + bitset.CountBytes
+	return haveBytes, haveBytes + (int64(leafs)+7)/8
+}
+
+//openState opens the state of key, if it does not exist, it is created
+//when create is true, else nil is returned.
+func (d *database) openState(key HLKey, create bool) (*fileState, error) {
+	leafs := ht.I.Nodes(key.GetLength())
+	haveBytes, stateBytes := stateSizes(leafs)
+	blob, err := d.stateStore.Get(key.FullBytes(), stateBytes)
+	if err == nil && blob == nil {
+		if !create {
+			return nil, nil
+		}
+		blob, err = d.stateStore.New(key.FullBytes(), stateBytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	mixed := d.stateJournal.wrap(key.FullBytes(), blob)
+	haveBlob, receivedBlob := bitset.SplitBlob(mixed, haveBytes)
+	s := &fileState{
+		have:     bitset.NewCounting(haveBlob, int(leafs)),
+		received: bitset.NewBlobBacked(receivedBlob, int(leafs)),
+		mixed:    mixed,
+	}
+	if mixed.err != nil {
+		return nil, s.Close()
+	}
+	return s, nil
+}
+
+//Close syncs the state in one journal commit, and returns the first error of
+//the state.
+func (s *fileState) Close() error {
+	s.have.Sync()
+	s.received.Sync()
+	s.mixed.Close()
+	return s.mixed.err
+}
+
+//blobRange returns the leafs and bytes of blob i in a file of length.
+func blobRange(length int64, i ht.Nodes) (fromLeaf, toLeaf ht.Nodes, off, size int64) {
+	leafs := ht.I.Nodes(length)
+	fromLeaf = i * blobLeafs
+	toLeaf = fromLeaf + blobLeafs
+	if toLeaf > leafs {
+		toLeaf = leafs
+	}
+	off = int64(i) * BlobSize
+	size = length - off
+	if size > BlobSize {
+		size = BlobSize
+	}
+	return
+}
+
+//blobKey is the key of a verified blob with hash.
+func blobKey(suite ht.SuiteID, hash []byte, size int64) []byte {
+	return NewSuiteHLKey(suite, hash, size).FullBytes()
+}
+
+//partKey is the key of blob i of file key, before it is verified.
+func partKey(key HLKey, i ht.Nodes) []byte {
+	k := append([]byte(nil), key.FullBytes()...)
+	var index [8]byte
+	binary.LittleEndian.PutUint64(index[:], uint64(i))
+	return append(k, index[:]...)
+}
+
+func (d *database) blobHash(key HLKey, i ht.Nodes) ([]byte, error) {
+	if key.GetLength() <= BlobSize {
+		//the only blob is the whole file, below InnerHashMinLevel
+		return key.GetHash(), nil
+	}
+	hash := make([]byte, hashSize)
+	err := d.GetInnerHashes(key, hash, d.minLevel, i)
+	if err != nil {
+		return nil, fmt.Errorf("hash of blob %v unknown: %v", i, err)
+	}
+	return hash, nil
+}
+
+//GetState reports a file with a state that can't be read as FilePart, as it
+//can't be read either.
+func (d *database) GetState(key HLKey) FileState {
+	d.fileLocks.lock(key.FullBytes())
+	defer d.fileLocks.unlock(key.FullBytes())
+	s, err := d.openState(key, false)
+	if err == nil && s == nil {
+		return FileNone
+	}
+	full := false
+	if err == nil {
+		full = s.have.Full()
+		err = s.Close()
+	}
+	if err != nil {
+		log.Printf("state of %x unreadable: %v", key.FullBytes(), err)
+		return FilePart
+	}
+	if ttl := d.TTLGet(key); ttl != TTLLongAgo && ttl < d.time.now() {
+		return FileExpired
+	}
+	if full {
+		return FileComplete
+	}
+	return FilePart
+}
+
+func (d *database) GetAt(key HLKey, b []byte, off int64) (err error) {
+	length := key.GetLength()
+	end := off + int64(len(b))
+	if off < 0 || end > length {
+		return fmt.Errorf("read from %v to %v out of file length %v", off, end, length)
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	d.fileLocks.lock(key.FullBytes())
+	defer d.fileLocks.unlock(key.FullBytes())
+	s, err := d.openState(key, false)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return fmt.Errorf("file not found")
+	}
+	defer func() {
+		if e := s.Close(); err == nil {
+			err = e
+		}
+	}()
+	for l := ht.Nodes(off / ht.LeafBlockSize); l < ht.Nodes((end+ht.LeafBlockSize-1)/ht.LeafBlockSize); l++ {
+		if !s.have.Get(int(l)) {
+			return fmt.Errorf("leaf %v not available", l)
+		}
+	}
+	for i := ht.Nodes(off / BlobSize); int64(i)*BlobSize < end; i++ {
+		_, _, bOff, size := blobRange(length, i)
+		hash, err := d.blobHash(key, i)
+		if err != nil {
+			return err
+		}
+		blob, err := d.dataStore.Get(blobKey(key.Suite(), hash, size), size)
+		if err == nil && blob == nil {
+			err = fmt.Errorf("blob %v is missing", i)
+		}
+		if err == nil {
+			from, to := maxInt64(off, bOff), minInt64(end, bOff+size)
+			err = blob.ReadAt(b[from-off:to-off], from-bOff)
+			blob.Close()
+		}
+		if err != nil {
+			d.setCorrupt(s, key, i)
+			return err
+		}
+	}
+	return nil
+}
+
+//setCorrupt marks the leafs of blob i as not verified, after it can't be read.
+func (d *database) setCorrupt(s *fileState, key HLKey, i ht.Nodes) {
+	fromLeaf, toLeaf, _, _ := blobRange(key.GetLength(), i)
+	for l := fromLeaf; l < toLeaf; l++ {
+		s.have.Unset(int(l))
+	}
+}
+
+func (d *database) PutAt(key HLKey, b []byte, off int64) (has ht.Nodes, complete bool, err error) {
+	length := key.GetLength()
+	end := off + int64(len(b))
+	if off < 0 || end > length || off%ht.LeafBlockSize != 0 ||
+		(end%ht.LeafBlockSize != 0 && end != length) {
+		return 0, false, fmt.Errorf("write from %v to %v not aligned to leafs of file length %v", off, end, length)
+	}
+	err = d.time.check()
+	if err != nil {
+		return 0, false, err
+	}
+	suite, err := ht.GetSuite(key.Suite())
+	if err != nil {
+		return 0, false, err
+	}
+	d.fileLocks.lock(key.FullBytes())
+	defer d.fileLocks.unlock(key.FullBytes())
+	s, err := d.openState(key, true)
+	if err != nil {
+		return 0, false, err
+	}
+	if length == 0 {
+		err = d.putBlob(key, suite, s, 0, nil, 0)
+	}
+	for i := ht.Nodes(off / BlobSize); err == nil && int64(i)*BlobSize < end; i++ {
+		_, _, bOff, size := blobRange(length, i)
+		from, to := maxInt64(off, bOff), minInt64(end, bOff+size)
+		err = d.putBlob(key, suite, s, i, b[from-off:to-off], from-bOff)
+	}
+	has, complete = ht.Nodes(s.have.Count()), s.have.Full()
+	if e := s.Close(); e != nil {
+		return 0, false, e
+	}
+	return has, complete, err
+}
+
+//putBlob checks and writes data at off of blob i, then verifies the blob once
+//all of it is received.
+func (d *database) putBlob(key HLKey, suite *ht.Suite, s *fileState, i ht.Nodes, data []byte, off int64) error {
+	fromLeaf, toLeaf, _, size := blobRange(key.GetLength(), i)
+	if s.have.Get(int(fromLeaf)) {
+		return nil //already verified, don't overwrite
+	}
+	hash, err := d.blobHash(key, i)
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		//an empty file has no blob
+		if !bytes.Equal(suite.NewFile().Sum(nil), hash) {
+			return fmt.Errorf("empty file does not have hash %x", hash)
+		}
+		s.have.Set(0)
+		return nil
+	}
+	shared, err := d.hasBlob(suite, hash, size)
+	if shared {
+		_, shared, err = d.checkBlob(suite, hash, make([]byte, size))
+	}
+	if err != nil {
+		return err
+	}
+	if shared {
+		//shared with an other file
+		d.setVerified(s, fromLeaf, toLeaf)
+		d.dataStore.Delete(partKey(key, i), size)
+		return d.deletePartTree(key, i)
+	}
+	first := ht.Nodes(off / ht.LeafBlockSize) //in the blob
+	err = d.checkLeafs(key, suite, i, hash, data, first)
+	if err != nil {
+		return err
+	}
+	pKey := partKey(key, i)
+	part, err := d.dataStore.Get(pKey, size)
+	if err == nil && part == nil {
+		part, err = d.dataStore.New(pKey, size)
+	}
+	if err != nil {
+		return err
+	}
+	err = part.WriteAt(data, off)
+	if err == nil {
+		err = part.Sync() //before received claims it
+	}
+	if err != nil {
+		part.Close()
+		return err
+	}
+	last := first + ht.Nodes((int64(len(data))+ht.LeafBlockSize-1)/ht.LeafBlockSize)
+	for l := fromLeaf + first; l < fromLeaf+last; l++ {
+		s.received.Set(int(l))
+	}
+	for l := fromLeaf; l < toLeaf; l++ {
+		if !s.received.Get(int(l)) {
+			part.Close()
+			return nil //wait for more
+		}
+	}
+	buf := make([]byte, size)
+	err = part.ReadAt(buf, 0)
+	part.Close()
+	if err != nil {
+		return err
+	}
+	h := suite.NewFile()
+	h.Write(buf)
+	if !bytes.Equal(h.Sum(nil), hash) {
+		dropped, err := d.dropUnverified(key, s, i, hash)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("blob %v failed hash check, %v leafs not verified by leaf hashes dropped", i, dropped)
+	}
+	err = d.moveBlob(suite, hash, pKey, buf)
+	if err != nil {
+		return err
+	}
+	err = d.deletePartTree(key, i)
+	if err != nil {
+		return err
+	}
+	if ttl := d.TTLGet(key); ttl != TTLLongAgo && key.GetLength() > BlobSize {
+		d.ttlSetLocked(NewSuiteHLKey(key.Suite(), hash, size), ttl, ttl)
+		d.ttlStore.Sync()
+	}
+	d.setVerified(s, fromLeaf, toLeaf)
+	return nil
+}
+
+//moveBlob moves the verified blob with data at from, to its blob key. If the
+//blob is saved by an other file in the mean time, from is deleted.
+func (d *database) moveBlob(suite *ht.Suite, hash []byte, from []byte, data []byte) error {
+	size := int64(len(data))
+	bKey := blobKey(suite.ID, hash, size)
+	err := d.dataStore.Move(from, size, bKey, size)
+	if err == nil {
+		return nil
+	}
+	found, ok, cerr := d.checkBlob(suite, hash, data)
+	if cerr != nil {
+		return cerr
+	}
+	if ok {
+		d.dataStore.Delete(from, size)
+		return nil
+	}
+	if found {
+		//the bad blob is deleted
+		return d.dataStore.Move(from, size, bKey, size)
+	}
+	return err
+}
+
+//hasBlob returns if the blob with hash is saved, without reading it.
+func (d *database) hasBlob(suite *ht.Suite, hash []byte, size int64) (bool, error) {
+	blob, err := d.dataStore.Get(blobKey(suite.ID, hash, size), size)
+	if blob == nil {
+		return false, err
+	}
+	return true, blob.Close()
+}
+
+//checkBlob reads the saved blob with hash to buf and verifies it, a blob that
+//is wrong is deleted. found is false if there is no blob. A blob that can't be
+//read is kept, and the error is returned.
+func (d *database) checkBlob(suite *ht.Suite, hash []byte, buf []byte) (found, ok bool, err error) {
+	size := int64(len(buf))
+	bKey := blobKey(suite.ID, hash, size)
+	blob, err := d.dataStore.Get(bKey, size)
+	if blob == nil {
+		return false, false, err
+	}
+	err = blob.ReadAt(buf, 0)
+	err2 := blob.Close()
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		return true, false, err
+	}
+	h := suite.NewFile()
+	h.Write(buf)
+	if bytes.Equal(h.Sum(nil), hash) {
+		return true, true, nil
+	}
+	_, err = d.dataStore.Delete(bKey, size)
+	return true, false, err
+}
+
+//partTree opens the hashes below minLevel of blob i of key with hash, which
+//are kept while the blob is downloaded.
+func (d *database) partTree(key HLKey, i ht.Nodes, hash []byte) (*hashTree, error) {
+	fromLeaf, toLeaf, _, _ := blobRange(key.GetLength(), i)
+	return d.openTree(partKey(key, i), toLeaf-fromLeaf, hash)
+}
+
+func (d *database) deletePartTree(key HLKey, i ht.Nodes) error {
+	fromLeaf, toLeaf, _, _ := blobRange(key.GetLength(), i)
+	blobBytes, _, _ := treeSizes(toLeaf - fromLeaf)
+	gone, err := d.hashStore.Delete(partKey(key, i), blobBytes)
+	if gone {
+		return nil
+	}
+	return err
+}
+
+//checkLeafs checks the leafs of data from leaf first of blob i with the known
+//hashes of the blob, and saves the leaf hashes that are verified. An error is
+//returned if any is wrong. Leafs that can't be checked yet are verified with
+//the whole blob.
+func (d *database) checkLeafs(key HLKey, suite *ht.Suite, i ht.Nodes, hash []byte, data []byte, first ht.Nodes) (err error) {
+	n := (int64(len(data)) + ht.LeafBlockSize - 1) / ht.LeafBlockSize
+	hs := make([]byte, n*hashSize)
+	for k := int64(0); k < n; k++ {
+		h := suite.NewLeaf()
+		h.Write(data[k*ht.LeafBlockSize : minInt64((k+1)*ht.LeafBlockSize, int64(len(data)))])
+		copy(hs[k*hashSize:], h.Sum(nil))
+	}
+	tree, err := d.partTree(key, i, hash)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := tree.Close(); err == nil {
+			err = e
+		}
+	}()
+	fromLeaf, _, _, _ := blobRange(key.GetLength(), i)
+	known := make([]byte, hashSize)
+	for k := int64(0); k < n; k++ {
+		l := int64(first) + k //leaf hashes are at the start of the tree
+		if !tree.known.Get(int(l)) {
+			continue
+		}
+		tree.hashes.ReadAt(known, l*hashSize)
+		if tree.mixed.err != nil {
+			return tree.mixed.err
+		}
+		if !bytes.Equal(known, hs[k*hashSize:(k+1)*hashSize]) {
+			return fmt.Errorf("leaf %v failed hash check", int64(fromLeaf)+l)
+		}
+	}
+	bad, err := tree.put(suite, hs, 0, first)
+	if err != nil {
+		return err
+	}
+	if bad {
+		return fmt.Errorf("leafs %v to %v failed hash check", fromLeaf+first, fromLeaf+first+ht.Nodes(n))
+	}
+	return nil
+}
+
+//dropUnverified unsets the received leafs of blob i that were not verified by
+//leaf hashes, or all of them if none are, and returns how many are dropped.
+func (d *database) dropUnverified(key HLKey, s *fileState, i ht.Nodes, hash []byte) (dropped int, err error) {
+	fromLeaf, toLeaf, _, _ := blobRange(key.GetLength(), i)
+	tree, err := d.partTree(key, i, hash)
+	if err != nil {
+		return 0, err
+	}
+	for l := fromLeaf; l < toLeaf; l++ {
+		if !tree.known.Get(int(l - fromLeaf)) {
+			s.received.Unset(int(l))
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		//the leafs are fine, so the blob changed after written
+		for l := fromLeaf; l < toLeaf; l++ {
+			s.received.Unset(int(l))
+		}
+		dropped = int(toLeaf - fromLeaf)
+	}
+	return dropped, tree.Close()
+}
+
+//PutInnerHashes also takes hashes below InnerHashMinLevel, of blobs not yet
+//verified, to verify their leafs as they are written.
+func (d *database) PutInnerHashes(key HLKey, hs []byte, level ht.Level, off ht.Nodes) (has ht.Nodes, complete bool, err error) {
+	err = d.time.check()
+	if err != nil {
+		return 0, false, err
+	}
+	if level >= d.minLevel {
+		return d.metaStore.PutInnerHashes(key, hs, level, off)
+	}
+	err = d.putPartHashes(key, hs, level, off)
+	if err != nil {
+		return 0, false, err
+	}
+	return d.hashCount(key)
+}
+
+//putPartHashes saves hashes at level below minLevel in the trees of the blobs
+//they are in. Hashes of blobs verified or with unknown hashes are left out.
+func (d *database) putPartHashes(key HLKey, hs []byte, level ht.Level, off ht.Nodes) (err error) {
+	n, _ := assertHashesInRange(key, hs, level, off)
+	suite, err := ht.GetSuite(key.Suite())
+	if err != nil {
+		return err
+	}
+	d.fileLocks.lock(key.FullBytes())
+	defer d.fileLocks.unlock(key.FullBytes())
+	s, err := d.openState(key, false)
+	if err != nil {
+		return err
+	}
+	if s != nil {
+		defer func() {
+			if e := s.Close(); err == nil {
+				err = e
+			}
+		}()
+	}
+	perBlob := ht.Nodes(1) << uint(d.minLevel-level)
+	for i := off / perBlob; i*perBlob < off+n; i++ {
+		fromLeaf, _, _, size := blobRange(key.GetLength(), i)
+		if size == 0 || (s != nil && s.have.Get(int(fromLeaf))) {
+			continue
+		}
+		hash, err := d.blobHash(key, i)
+		if err != nil {
+			continue
+		}
+		from, to := off, off+n
+		if from < i*perBlob {
+			from = i * perBlob
+		}
+		if to > (i+1)*perBlob {
+			to = (i + 1) * perBlob
+		}
+		tree, err := d.partTree(key, i, hash)
+		if err != nil {
+			return err
+		}
+		_, err = tree.put(suite, hs[(from-off)*hashSize:(to-off)*hashSize], level, from-i*perBlob)
+		if e := tree.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//TTLSetAtleast also keeps the blobs of the file until at least until, as
+//blobs can be shared by files, and are collected by their own TTL.
+func (d *database) TTLSetAtleast(key HLKey, freeFrom, until TTL) (byteMonth int64) {
+	byteMonth = d.ttlSetLocked(key, freeFrom, until)
+	defer d.ttlStore.Sync()
+	length := key.GetLength()
+	if length <= BlobSize {
+		return //the file is the blob
+	}
+	blobs := ht.Nodes((length + BlobSize - 1) / BlobSize)
+	hashes := make([]byte, int64(blobs)*hashSize)
+	d.GetInnerHashes(key, hashes, d.minLevel, 0) //unknown hashes are zeros
+	zero := make([]byte, hashSize)
+	for i := ht.Nodes(0); i < blobs; i++ {
+		hash := hashes[int64(i)*hashSize : int64(i+1)*hashSize]
+		if bytes.Equal(hash, zero) {
+			continue
+		}
+		_, _, _, size := blobRange(length, i)
+		d.ttlSetLocked(NewSuiteHLKey(key.Suite(), hash, size), until, until)
+	}
+	return
+}
+
+//ttlSetLocked is ttlSetAtleast with the file of key locked, so that remove
+//sees the new TTL, or is done before it.
+func (d *database) ttlSetLocked(key HLKey, freeFrom, until TTL) (byteMonth int64) {
+	d.fileLocks.lock(key.FullBytes())
+	defer d.fileLocks.unlock(key.FullBytes())
+	return d.metaStore.ttlSetAtleast(key, freeFrom, until)
+}
+
+func (d *database) setVerified(s *fileState, fromLeaf, toLeaf ht.Nodes) {
+	for l := fromLeaf; l < toLeaf; l++ {
+		s.have.Set(int(l))
+		s.received.Unset(int(l))
+	}
+}
+
+//ImportFromReader reads, hashes, and saves a blob at a time. Blobs already
+//saved are not written again, so importing the same data twice, or data with
+//the same blobs as other files, takes no more disk space.
+func (d *database) ImportFromReader(r io.Reader) (HLKey, error) {
+	err := d.time.check()
+	if err != nil {
+		return nil, err
+	}
+	suite, err := ht.GetSuite(ht.SuiteSHA256)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, BlobSize)
+	var blobHashes []byte
+	var length int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF && length > 0 {
+			break
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		h := ht.NewFile()
+		h.Write(buf[:n])
+		hash := h.Sum(nil)
+		blobHashes = append(blobHashes, hash...)
+		length += int64(n)
+		if n > 0 {
+			err = d.importBlob(suite, hash, buf[:n])
+			if err != nil {
+				return nil, err
+			}
+		}
+		if n < BlobSize {
+			break
+		}
+	}
+
+	root := blobHashes
+	if len(blobHashes) > hashSize {
+		tree := ht.NewNoPadTree()
+		tree.Write(blobHashes)
+		root = tree.Sum(nil)
+	}
+	key := NewHLKey(root, length)
+	if len(blobHashes) > hashSize {
+		_, complete, err := d.PutInnerHashes(key, blobHashes, d.minLevel, 0)
+		if err != nil {
+			return nil, err
+		}
+		if !complete {
+			return nil, fmt.Errorf("inner hashes of import not saved")
+		}
+	}
+	d.fileLocks.lock(key.FullBytes())
+	defer d.fileLocks.unlock(key.FullBytes())
+	s, err := d.openState(key, true)
+	if err != nil {
+		return nil, err
+	}
+	d.setVerified(s, 0, ht.I.Nodes(length))
+	err = s.Close()
+	if err != nil {
+		return nil, err
+	}
+	for i := ht.Nodes(0); int64(i)*BlobSize < length; i++ {
+		//parts from an earlier download
+		_, _, _, size := blobRange(length, i)
+		d.dataStore.Delete(partKey(key, i), size)
+		err = d.deletePartTree(key, i)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+//importBlob saves data as the blob with hash, if it's not saved yet. It's
+//written under importKey first, so a blob key only has verified data.
+func (d *database) importBlob(suite *ht.Suite, hash []byte, data []byte) error {
+	size := int64(len(data))
+	bKey := blobKey(suite.ID, hash, size)
+	d.fileLocks.lock(bKey)
+	defer d.fileLocks.unlock(bKey)
+	has, err := d.hasBlob(suite, hash, size)
+	if has {
+		_, has, err = d.checkBlob(suite, hash, make([]byte, size))
+	}
+	if has || err != nil {
+		return err
+	}
+	iKey := importKey(bKey)
+	blob, err := d.dataStore.Get(iKey, size)
+	if err == nil && blob == nil {
+		blob, err = d.dataStore.New(iKey, size)
+	}
+	if err != nil {
+		return err
+	}
+	err = blob.WriteAt(data, 0)
+	if err == nil {
+		err = blob.Sync()
+	}
+	err2 := blob.Close()
+	if err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = d.moveBlob(suite, hash, iKey, data)
+	}
+	if err != nil {
+		d.dataStore.Delete(iKey, size)
+	}
+	return err
+}
+
+//importKey is the key of a blob being imported, before it's moved to bKey.
+//One left by a crash is used again by the next import of the blob.
+func importKey(bKey []byte) []byte {
+	return append(append([]byte(nil), bKey...), "import"...)
+}
+
+func (d *database) Close() error {
+	err := d.metaStore.Close()
+	err2 := d.dataStore.Close()
+	err3 := d.stateStore.Close()
+	err4 := d.verifiedStore.Close()
+	if e := d.stateJournal.Close(); err3 == nil {
+		err3 = e
+	}
+	if err != nil || err2 != nil || err3 != nil || err4 != nil {
+		return fmt.Errorf("fail close database, meta err: %v; data err: %v; state err: %v; verified err: %v", err, err2, err3, err4)
+	}
+	return nil
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,458 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	ht "github.com/xiegeo/fensan/hashtree"
+)
+
+func testData(length int, seed int64) []byte {
+	b := make([]byte, length)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+//testKey returns the key of data, and the hashes of it's blobs
+func testKey(t *testing.T, data []byte) (HLKey, []byte) {
+	length := int64(len(data))
+	tree, err := ht.TreeListing(bytes.NewReader(data), length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafs := ht.I.Nodes(length)
+	top := ht.Levels(leafs) - 1
+	key := NewHLKey(tree[ht.HashPosition(leafs, top, 0):], length)
+	if length <= BlobSize {
+		return key, key.GetHash()
+	}
+	level := ht.Levels(BlobSize/ht.LeafBlockSize) - 1
+	from := ht.HashPosition(leafs, level, 0)
+	return key, tree[from : from+int64(ht.LevelWidth(leafs, level))*hashSize]
+}
+
+func openTestDatabase(t *testing.T, path string) Database {
+	err := os.RemoveAll(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestDatabasePutGet(t *testing.T) {
+	path := ".testDatabase"
+	db := openTestDatabase(t, path)
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	data := testData(BlobSize*2+5000, 1)
+	key, blobHashes := testKey(t, data)
+	if db.GetState(key) != FileNone {
+		t.Fatal("new file should be none")
+	}
+	_, _, err := db.PutAt(key, data[:BlobSize], 0)
+	if err == nil {
+		t.Fatal("put without hashes accepted")
+	}
+	_, complete, err := db.PutInnerHashes(key, blobHashes, db.InnerHashMinLevel(), 0)
+	if err != nil || !complete {
+		t.Fatal(complete, err)
+	}
+
+	_, _, err = db.PutAt(key, data[:1000], 0)
+	if err == nil {
+		t.Fatal("unaligned put accepted")
+	}
+	bad := append([]byte(nil), data[:BlobSize]...)
+	bad[500]++
+	has, _, err := db.PutAt(key, bad, 0)
+	if err == nil || has != 0 {
+		t.Fatal("bad data accepted", has, err)
+	}
+	if db.GetState(key) != FilePart {
+		t.Fatal("file should be in part")
+	}
+
+	//blob 1 in pieces, out of order
+	piece := int64(1 << 20)
+	for _, p := range []int64{3, 1, 0} {
+		off := BlobSize + p*piece
+		has, _, err = db.PutAt(key, data[off:off+piece], off)
+		if err != nil || has != 0 {
+			t.Fatal("incomplete blob counted", has, err)
+		}
+	}
+	if db.GetAt(key, make([]byte, 10), BlobSize) == nil {
+		t.Fatal("read of unverified data")
+	}
+	off := BlobSize + 2*piece
+	has, complete, err = db.PutAt(key, data[off:off+piece], off)
+	if err != nil || has != blobLeafs || complete {
+		t.Fatal(has, complete, err)
+	}
+	got := make([]byte, 3000)
+	err = db.GetAt(key, got, BlobSize+1000)
+	if err != nil || !bytes.Equal(got, data[BlobSize+1000:BlobSize+4000]) {
+		t.Fatal("read back failed", err)
+	}
+
+	has, complete, err = db.PutAt(key, data[:BlobSize], 0)
+	if err != nil || has != 2*blobLeafs || complete {
+		t.Fatal(has, complete, err)
+	}
+	has, complete, err = db.PutAt(key, data[BlobSize*2:], BlobSize*2)
+	if err != nil || has != ht.I.Nodes(key.GetLength()) || !complete {
+		t.Fatal(has, complete, err)
+	}
+	if db.GetState(key) != FileComplete {
+		t.Fatal("file should be complete")
+	}
+	got = make([]byte, len(data))
+	err = db.GetAt(key, got, 0)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatal("read back failed", err)
+	}
+
+	//a file sharing the first blob only need the rest
+	data2 := append(append([]byte(nil), data[:BlobSize]...), testData(100, 2)...)
+	key2, blobHashes2 := testKey(t, data2)
+	db.PutInnerHashes(key2, blobHashes2, db.InnerHashMinLevel(), 0)
+	has, complete, err = db.PutAt(key2, data2[BlobSize:], BlobSize)
+	if err != nil || has != 1 || complete {
+		t.Fatal(has, complete, err)
+	}
+	has, complete, err = db.PutAt(key2, make([]byte, ht.LeafBlockSize), 0)
+	if err != nil || has != blobLeafs+1 || !complete {
+		t.Fatal("shared blob should be used without the rest of the data", has, complete, err)
+	}
+}
+
+func TestDatabaseLeafCheck(t *testing.T) {
+	path := ".testDatabaseLeafCheck"
+	db := openTestDatabase(t, path)
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	data := testData(BlobSize+5*ht.LeafBlockSize, 4)
+	length := int64(len(data))
+	key, blobHashes := testKey(t, data)
+	db.PutInnerHashes(key, blobHashes, db.InnerHashMinLevel(), 0)
+	tree, err := ht.TreeListing(bytes.NewReader(data), length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafs := ht.I.Nodes(length)
+	from := ht.HashPosition(leafs, 0, 0)
+	has, complete, err := db.PutInnerHashes(key, tree[from:from+blobLeafs*hashSize], 0, 0)
+	if err != nil || has != 3 || !complete {
+		t.Fatal(has, complete, err)
+	}
+
+	leaf := int64(ht.LeafBlockSize)
+	bad := append([]byte(nil), data[:2*leaf]...)
+	bad[leaf+10]++
+	has, _, err = db.PutAt(key, bad, 0)
+	if err == nil || has != 0 {
+		t.Fatal("bad leaf accepted", has, err)
+	}
+	has, _, err = db.PutAt(key, data[leaf:BlobSize], leaf)
+	if err != nil || has != 0 {
+		t.Fatal(has, err)
+	}
+	has, _, err = db.PutAt(key, data[:leaf], 0)
+	if err != nil || has != blobLeafs {
+		t.Fatal(has, err)
+	}
+
+	//blob 1 has no leaf hashes, so it's only checked at the end
+	bad = append([]byte(nil), data[BlobSize:]...)
+	bad[10]++
+	_, _, err = db.PutAt(key, bad[:leaf], BlobSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = db.PutAt(key, bad[leaf:], BlobSize+leaf)
+	if err == nil {
+		t.Fatal("bad blob accepted")
+	}
+	has, complete, err = db.PutAt(key, data[BlobSize:], BlobSize)
+	if err != nil || has != leafs || !complete {
+		t.Fatal(has, complete, err)
+	}
+	if n, _ := countFiles(t, path+"/m_hash"); n != 1 {
+		t.Error("hashes of blobs left:", n)
+	}
+}
+
+func TestDatabaseConcurrentPut(t *testing.T) {
+	path := ".testDatabaseConcurrent"
+	db := openTestDatabase(t, path)
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	data := testData(BlobSize, 5)
+	key, _ := testKey(t, data)
+	pieces := int64(16)
+	piece := int64(len(data)) / pieces
+	var wg sync.WaitGroup
+	for p := int64(0); p < pieces; p++ {
+		wg.Add(1)
+		go func(off int64) {
+			defer wg.Done()
+			_, _, err := db.PutAt(key, data[off:off+piece], off)
+			if err != nil {
+				t.Error(err)
+			}
+		}(p * piece)
+	}
+	wg.Wait()
+	if db.GetState(key) != FileComplete {
+		t.Fatal("writes are lost")
+	}
+}
+
+func TestDatabaseSmallFiles(t *testing.T) {
+	path := ".testDatabaseSmall"
+	db := openTestDatabase(t, path)
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	for _, length := range []int{0, 1, 1024, 5000} {
+		data := testData(length, int64(length))
+		key, _ := testKey(t, data)
+		_, complete, err := db.PutAt(key, data, 0)
+		if err != nil || !complete {
+			t.Fatal(length, complete, err)
+		}
+		got := make([]byte, length)
+		err = db.GetAt(key, got, 0)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatal(length, "read back failed", err)
+		}
+	}
+}
+
+func countFiles(t *testing.T, path string) (files int, size int64) {
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if _, _, ok := fileToByte(info.Name()); ok && !info.IsDir() {
+			files++
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestDatabaseImport(t *testing.T) {
+	path := ".testDatabaseImport"
+	db := openTestDatabase(t, path)
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	data := testData(BlobSize*2+5000, 4)
+	for _, d := range [][]byte{data, data[:BlobSize*2], data[:100], nil} {
+		key, err := db.ImportFromReader(bytes.NewReader(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect, _ := testKey(t, d)
+		if !bytes.Equal(key.FullBytes(), expect.FullBytes()) {
+			t.Fatalf("length %v: wrong key", len(d))
+		}
+		if db.GetState(key) != FileComplete {
+			t.Fatalf("length %v: import not complete", len(d))
+		}
+		got := make([]byte, len(d))
+		err = db.GetAt(key, got, 0)
+		if err != nil || !bytes.Equal(got, d) {
+			t.Fatalf("length %v: read back failed: %v", len(d), err)
+		}
+	}
+
+	files, size := countFiles(t, path+"/d_data")
+	if files != 4 || size != int64(len(data))+100 {
+		t.Fatalf("%v blobs of %v bytes saved", files, size)
+	}
+	_, err := db.ImportFromReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files2, size2 := countFiles(t, path+"/d_data")
+	if files2 != files || size2 != size {
+		t.Fatal("duplicate import used more disk")
+	}
+}
+
+func TestDatabaseImportOverBadBlob(t *testing.T) {
+	path := ".testDatabaseImportBad"
+	db := openTestDatabase(t, path)
+	defer os.RemoveAll(path)
+	defer db.Close()
+	d := db.(*database)
+
+	//a blob left zero filled, such as by a crash while it was written
+	data := testData(BlobSize+5000, 6)
+	key, blobHashes := testKey(t, data)
+	bKey := blobKey(key.Suite(), blobHashes[:hashSize], BlobSize)
+	blob, err := d.dataStore.New(bKey, BlobSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob.Close()
+
+	d.PutInnerHashes(key, blobHashes, d.minLevel, 0)
+	has, _, err := d.PutAt(key, data[:ht.LeafBlockSize], 0)
+	if err != nil || has != 0 {
+		t.Fatal("bad shared blob trusted", has, err)
+	}
+	_, err = db.ImportFromReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	err = db.GetAt(key, got, 0)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatal("read back failed", err)
+	}
+	if files, _ := countFiles(t, path+"/d_data"); files != 2 {
+		t.Fatalf("%v blobs saved", files)
+	}
+}
+
+//failingLV returns a blob that can't be read for key bad.
+type failingLV struct {
+	LVE
+	bad []byte
+}
+
+type failingBlob struct {
+	BlobE
+}
+
+func (f failingLV) Get(key []byte, size int64) (BlobE, error) {
+	b, err := f.LVE.Get(key, size)
+	if b == nil || !bytes.Equal(key, f.bad) {
+		return b, err
+	}
+	return failingBlob{b}, err
+}
+
+func (f failingBlob) ReadAt(b []byte, off int64) error {
+	return errors.New("bad sector")
+}
+
+func TestDatabaseReadError(t *testing.T) {
+	path := ".testDatabaseReadError"
+	db := openTestDatabase(t, path)
+	defer os.RemoveAll(path)
+	defer db.Close()
+	d := db.(*database)
+
+	data := testData(BlobSize+100, 6)
+	key, err := db.ImportFromReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, blobHashes := testKey(t, data)
+	d.dataStore = failingLV{d.dataStore, blobKey(key.Suite(), blobHashes[hashSize:], 100)}
+	if db.GetAt(key, make([]byte, 10), BlobSize) == nil {
+		t.Fatal("read error not reported")
+	}
+	if db.GetState(key) != FilePart {
+		t.Fatal("blob not marked corrupt")
+	}
+	if db.GetAt(key, make([]byte, 10), 0) != nil {
+		t.Fatal("error on the other blob")
+	}
+	d.dataStore = d.dataStore.(failingLV).LVE
+	_, complete, err := db.PutAt(key, data[BlobSize:], BlobSize)
+	if err != nil || !complete {
+		t.Fatal(complete, err)
+	}
+}
+
+func TestCheckBlobReadError(t *testing.T) {
+	path := ".testCheckBlobReadError"
+	db := openTestDatabase(t, path)
+	defer os.RemoveAll(path)
+	defer db.Close()
+	d := db.(*database)
+
+	data := testData(100, 6)
+	key, err := db.ImportFromReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	suite, err := ht.GetSuite(key.Suite())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lv := d.dataStore
+	d.dataStore = failingLV{lv, blobKey(key.Suite(), key.GetHash(), 100)}
+	found, ok, err := d.checkBlob(suite, key.GetHash(), make([]byte, 100))
+	if !found || ok || err == nil {
+		t.Fatal("read error not returned", found, ok, err)
+	}
+	d.dataStore = lv
+	if has, err := d.hasBlob(suite, key.GetHash(), 100); !has || err != nil {
+		t.Fatal("blob deleted on a read error", err)
+	}
+}
+
+func TestDatabaseMetaReadError(t *testing.T) {
+	path := ".testDatabaseMetaReadError"
+	db := openTestDatabase(t, path)
+	defer os.RemoveAll(path)
+	defer db.Close()
+	d := db.(*database)
+
+	data := testData(BlobSize+100, 7)
+	key, err := db.ImportFromReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a bad hash blob
+	hashStore := d.hashStore
+	d.hashStore = failingLV{hashStore, key.GetHash()}
+	if db.GetAt(key, make([]byte, 10), 0) == nil {
+		t.Error("hash read error not reported by GetAt")
+	}
+	if _, _, err := db.PutInnerHashes(key, make([]byte, hashSize), d.minLevel, 0); err == nil {
+		t.Error("hash read error not reported by PutInnerHashes")
+	}
+	d.hashStore = hashStore
+	if db.GetAt(key, make([]byte, 10), 0) != nil {
+		t.Error("hashes changed by the errors")
+	}
+
+	//a bad state blob
+	_, stateBytes := stateSizes(ht.I.Nodes(key.GetLength()))
+	_, file := d.stateStore.byteToFile(key.FullBytes(), stateBytes)
+	os.Remove(file)
+	os.Mkdir(file, 0777)
+	if db.GetAt(key, make([]byte, 10), 0) == nil {
+		t.Error("state read error not reported by GetAt")
+	}
+	if _, _, err := db.PutAt(key, data[:ht.LeafBlockSize], 0); err == nil {
+		t.Error("state read error not reported by PutAt")
+	}
+	if db.GetState(key) != FilePart {
+		t.Error("unreadable state is not FilePart")
+	}
+}
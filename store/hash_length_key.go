@@ -26,6 +26,8 @@ type HLKey interface {
 	GetHash() []byte
 	//Length returns the length of refereced file in bytes
 	GetLength() int64
+	//Suite returns the hash suite used to make the hash
+	Suite() ht.SuiteID
 	//FullBytes is used when a key need to include length, as an attacker might
 	//claim the existence of a file of the same hash but different size.
 	//Do not modify the returned contests
@@ -35,14 +37,59 @@ type HLKey interface {
 type hLKey struct {
 	fullBytes []byte
 	length    int64
+	suite     ht.SuiteID
 }
 
-//NewHLKey create a new HLKey, the hash is deep copied
+//NewHLKey create a new HLKey of the default suite, the hash is deep copied
 func NewHLKey(hash []byte, length int64) HLKey {
-	fb := make([]byte, ht.HashSize+8)
+	return NewSuiteHLKey(ht.SuiteSHA256, hash, length)
+}
+
+//NewSuiteHLKey create a new HLKey of hash made by suite, the hash is deep copied.
+//
+//FullBytes of the default suite is the hash and length as always, other suites
+//add the suite at the end, so that keys already saved stay the same.
+func NewSuiteHLKey(suite ht.SuiteID, hash []byte, length int64) HLKey {
+	size := ht.HashSize + 8
+	if suite != ht.SuiteSHA256 {
+		size += 4
+	}
+	fb := make([]byte, size)
 	copy(fb[:ht.HashSize], hash)
 	littleEndianPutUint64(fb[ht.HashSize:], uint64(length))
-	return &hLKey{fb, length}
+	if suite != ht.SuiteSHA256 {
+		littleEndianPutUint32(fb[ht.HashSize+8:], uint32(suite))
+	}
+	return &hLKey{fb, length, suite}
+}
+
+//HLKeyFromStaticId create a new HLKey from the network representation.
+func HLKeyFromStaticId(id *pb.StaticId) HLKey {
+	suite := ht.SuiteSHA256
+	if id.Algorithm != nil {
+		suite = ht.SuiteID(*id.Algorithm)
+	}
+	return NewSuiteHLKey(suite, id.GetHash(), id.GetLength())
+}
+
+//hLKeyFromFullBytes reverses FullBytes, ok is false if b is not from FullBytes.
+func hLKeyFromFullBytes(b []byte) (key HLKey, ok bool) {
+	suite := ht.SuiteSHA256
+	switch len(b) {
+	case ht.HashSize + 8:
+	case ht.HashSize + 12:
+		suite = ht.SuiteID(littleEndianUint32(b[ht.HashSize+8:]))
+		if suite == ht.SuiteSHA256 {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+	length := int64(littleEndianUint64(b[ht.HashSize:]))
+	if length < 0 {
+		return nil, false
+	}
+	return NewSuiteHLKey(suite, b[:ht.HashSize], length), true
 }
 
 func (k *hLKey) Proto() proto.Message {
@@ -61,6 +108,19 @@ func (k *hLKey) GetLength() int64 {
 	return k.length
 }
 
+func (k *hLKey) Suite() ht.SuiteID {
+	return k.suite
+}
+
+//GetAlgorithm is the suite as in pb.StaticId, nil for the default suite
+func (k *hLKey) GetAlgorithm() *int32 {
+	if k.suite == ht.SuiteSHA256 {
+		return nil
+	}
+	a := int32(k.suite)
+	return &a
+}
+
 //from encoding/binary/binary.go func (littleEndian) PutUint64
 func littleEndianPutUint64(b []byte, v uint64) {
 	b[0] = byte(v)
@@ -73,10 +133,21 @@ func littleEndianPutUint64(b []byte, v uint64) {
 	b[7] = byte(v >> 56)
 }
 
+//from encoding/binary/binary.go func (littleEndian) PutUint32
+func littleEndianPutUint32(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+	b[3] = byte(v >> 24)
+}
+
 //from encoding/binary/binary.go func (littleEndian) Uint64
-/* unused
 func littleEndianUint64(b []byte) uint64 {
 	return uint64(b[0]) | uint64(b[1])<<8 | uint64(b[2])<<16 | uint64(b[3])<<24 |
 		uint64(b[4])<<32 | uint64(b[5])<<40 | uint64(b[6])<<48 | uint64(b[7])<<56
 }
-*/
+
+//from encoding/binary/binary.go func (littleEndian) Uint32
+func littleEndianUint32(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+}
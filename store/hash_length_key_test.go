@@ -0,0 +1,38 @@
+package store
+
+import (
+	"bytes"
+	"testing"
+
+	ht "github.com/xiegeo/fensan/hashtree"
+	"github.com/xiegeo/fensan/pb"
+)
+
+func TestHLKeySuite(t *testing.T) {
+	hash := make([]byte, ht.HashSize)
+	hash[0] = 1
+	k := NewHLKey(hash, 100)
+	if len(k.FullBytes()) != ht.HashSize+8 || k.Suite() != ht.SuiteSHA256 {
+		t.Fatal("default suite keys must not change")
+	}
+	k2 := NewSuiteHLKey(ht.SuiteBLAKE2b, hash, 100)
+	if bytes.Equal(k.FullBytes(), k2.FullBytes()) {
+		t.Fatal("keys of different suites must differ")
+	}
+
+	for _, key := range []HLKey{k, k2} {
+		data, err := pb.NewStaticIdFromFace(key.(pb.StaticIdFace)).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := &pb.StaticId{}
+		err = id.Unmarshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := HLKeyFromStaticId(id)
+		if !bytes.Equal(got.FullBytes(), key.FullBytes()) || got.Suite() != key.Suite() {
+			t.Errorf("%v changed to %v", key, got)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+)
+
+//journal makes the writes to a blob of a LV atomic, so a bitset never counts
+//hashes or data that are not written, even if writes reach the disk in any
+//order before a crash.
+//
+//Writes to blobs from wrap are kept in memory by pages. At Sync, they are
+//written to the journal file and synced, then written to the blob and synced,
+//then the journal file is emptied. The journal is replayed on open, to finish
+//the writes of a crash after the journal is synced. Blobs synced while the
+//journal is written are committed together in the next record.
+//
+//The journal file has records of: the length and crc32 of the body in 4 bytes
+//little endian each, then the body, which is a list of: length of key in 2
+//bytes, key, size of blob in 8 bytes, offset in 8 bytes, length of data in 4
+//bytes, and data.
+type journal struct {
+	mu      sync.Mutex
+	f       *os.File
+	lv      LVE
+	kept    int64         //bytes of records not all applied, replayed on open
+	next    *journalBatch //blobs waiting for the journal
+	writing bool          //a batch is being committed
+	done    *sync.Cond    //of mu, when a batch is committed
+}
+
+//journalBatch is the blobs of a record, errs are set when it's done.
+type journalBatch struct {
+	blobs []*journalBlob
+	errs  []error
+	done  bool
+}
+
+const journalPageSize = 4096
+
+//openJournal opens the journal of lv in file, and replays it.
+func openJournal(file string, lv LVE) (*journal, error) {
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	j := &journal{f: f, lv: lv}
+	j.done = sync.NewCond(&j.mu)
+	err = j.replay()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *journal) replay() error {
+	data, err := ioutil.ReadAll(j.f)
+	if err != nil {
+		return err
+	}
+	for len(data) >= 8 {
+		n := int64(littleEndianUint32(data))
+		if 8+n > int64(len(data)) || crc32.ChecksumIEEE(data[8:8+n]) != littleEndianUint32(data[4:]) {
+			break //not synced before the crash, so none of it is applied
+		}
+		writes, ok := parseJournalBody(data[8 : 8+n])
+		if !ok {
+			break
+		}
+		err = j.replayWrites(writes)
+		if err != nil {
+			return err
+		}
+		data = data[8+n:]
+	}
+	if len(data) > 0 {
+		log.Printf("journal %v: dropping %v bytes of a torn or corrupt record, "+
+			"this should only happen after a crash", j.f.Name(), len(data))
+	}
+	return j.clear()
+}
+
+//journalWrite is a write to a blob in a journal record.
+type journalWrite struct {
+	key       []byte
+	size, off int64
+	data      []byte
+}
+
+//parseJournalBody returns the writes of a record body, ok is false if it's
+//corrupted.
+func parseJournalBody(body []byte) (writes []journalWrite, ok bool) {
+	for len(body) > 0 {
+		if len(body) < 2 {
+			return nil, false
+		}
+		keyLen := int(body[0]) | int(body[1])<<8
+		if len(body) < 2+keyLen+8+8+4 {
+			return nil, false
+		}
+		key := body[2 : 2+keyLen]
+		body = body[2+keyLen:]
+		size := int64(littleEndianUint64(body))
+		off := int64(littleEndianUint64(body[8:]))
+		n := int64(littleEndianUint32(body[16:]))
+		body = body[20:]
+		if n > int64(len(body)) || off < 0 || off+n > size {
+			return nil, false
+		}
+		writes = append(writes, journalWrite{key, size, off, body[:n]})
+		body = body[n:]
+	}
+	return writes, true
+}
+
+func (j *journal) replayWrites(writes []journalWrite) error {
+	for _, w := range writes {
+		blob, err := j.lv.Get(w.key, w.size)
+		if err != nil {
+			return err
+		}
+		if blob == nil {
+			continue //deleted after the journal was synced
+		}
+		err = blob.WriteAt(w.data, w.off)
+		if err == nil {
+			err = blob.Sync()
+		}
+		if e := blob.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//clear empties the journal after its writes are synced.
+func (j *journal) clear() error {
+	err := j.f.Truncate(0)
+	if err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+//wrap returns a blob of key, that writes to blob through the journal. A nil
+//journal writes to blob at Sync without a journal.
+func (j *journal) wrap(key []byte, blob BlobE) *journalBlob {
+	return &journalBlob{blob: blob, j: j, key: key, pages: make(map[int64][]byte)}
+}
+
+//commit writes the pages of b with the journal. While a batch is written, b
+//waits for the next, and the first to wait writes it.
+func (j *journal) commit(b *journalBlob) error {
+	if len(b.pages) == 0 {
+		return b.blob.Sync()
+	}
+	if j == nil {
+		return b.apply(b.offsets())
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	batch := j.next
+	if batch == nil {
+		batch = &journalBatch{}
+		j.next = batch
+	}
+	i := len(batch.blobs)
+	batch.blobs = append(batch.blobs, b)
+	for j.writing && !batch.done {
+		j.done.Wait()
+	}
+	if !batch.done {
+		j.next = nil
+		j.writing = true
+		j.mu.Unlock()
+		j.write(batch)
+		j.mu.Lock()
+		j.writing = false
+		batch.done = true
+		j.done.Broadcast()
+	}
+	return batch.errs[i]
+}
+
+//write commits the blobs of batch in one record. The journal is emptied only
+//if all blobs of all records are written, else the records are kept, and new
+//records are added after them, to be replayed in order on open.
+func (j *journal) write(batch *journalBatch) {
+	batch.errs = make([]error, len(batch.blobs))
+	record := journalRecord(batch.blobs)
+	_, err := j.f.WriteAt(record, j.kept)
+	if err == nil {
+		err = j.f.Truncate(j.kept + int64(len(record))) //of an earlier record
+	}
+	if err == nil {
+		err = j.f.Sync()
+	}
+	failed := err != nil
+	for i, b := range batch.blobs {
+		if err == nil {
+			batch.errs[i] = b.apply(b.offsets())
+		} else {
+			batch.errs[i] = err
+		}
+		failed = failed || batch.errs[i] != nil
+	}
+	if failed || j.kept > 0 {
+		if err == nil {
+			j.kept += int64(len(record))
+		}
+		return
+	}
+	err = j.clear()
+	if err != nil {
+		for i := range batch.errs {
+			batch.errs[i] = err
+		}
+	}
+}
+
+//apply writes the pages of b at offs to the blob, and syncs it.
+func (b *journalBlob) apply(offs []int64) error {
+	for _, off := range offs {
+		err := b.blob.WriteAt(b.pages[off], off)
+		if err != nil {
+			return err
+		}
+	}
+	err := b.blob.Sync()
+	if err != nil {
+		return err
+	}
+	b.pages = make(map[int64][]byte)
+	return nil
+}
+
+//offsets returns the offsets of the pages in b in order.
+func (b *journalBlob) offsets() []int64 {
+	offs := make([]int64, 0, len(b.pages))
+	for off := range b.pages {
+		offs = append(offs, off)
+	}
+	sort.Slice(offs, func(i, k int) bool { return offs[i] < offs[k] })
+	return offs
+}
+
+//journalRecord returns the journal record of the pages in blobs.
+func journalRecord(blobs []*journalBlob) []byte {
+	var body []byte
+	var head [20]byte
+	for _, b := range blobs {
+		for _, off := range b.offsets() {
+			page := b.pages[off]
+			body = append(body, byte(len(b.key)), byte(len(b.key)>>8))
+			body = append(body, b.key...)
+			binary.LittleEndian.PutUint64(head[:], uint64(b.Size()))
+			binary.LittleEndian.PutUint64(head[8:], uint64(off))
+			binary.LittleEndian.PutUint32(head[16:], uint32(len(page)))
+			body = append(body, head[:]...)
+			body = append(body, page...)
+		}
+	}
+	record := make([]byte, 8, 8+len(body))
+	binary.LittleEndian.PutUint32(record, uint32(len(body)))
+	binary.LittleEndian.PutUint32(record[4:], crc32.ChecksumIEEE(body))
+	return append(record, body...)
+}
+
+func (j *journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	return j.f.Close()
+}
+
+//journalBlob keeps writes to blob in pages, until Sync. It's a Blob for
+//bitsets, so the first error is kept in err instead of panicking, after which
+//reads are zeros and nothing is written. Check err before using what is read.
+type journalBlob struct {
+	blob  BlobE
+	j     *journal
+	key   []byte
+	pages map[int64][]byte //by offset
+	err   error
+}
+
+func (b *journalBlob) Size() int64 {
+	return b.blob.Size()
+}
+
+func (b *journalBlob) ReadAt(p []byte, off int64) {
+	if b.err == nil {
+		b.err = b.blob.ReadAt(p, off)
+	}
+	if b.err != nil {
+		for i := range p {
+			p[i] = 0
+		}
+		return
+	}
+	for start := off / journalPageSize * journalPageSize; start < off+int64(len(p)); start += journalPageSize {
+		page, ok := b.pages[start]
+		if !ok {
+			continue
+		}
+		from, to := maxInt64(start, off), minInt64(start+int64(len(page)), off+int64(len(p)))
+		copy(p[from-off:to-off], page[from-start:])
+	}
+}
+
+func (b *journalBlob) WriteAt(p []byte, off int64) {
+	if off < 0 || off+int64(len(p)) > b.Size() {
+		panic(fmt.Errorf("out of range:%v + %v > %v", len(p), off, b.Size()))
+	}
+	for start := off / journalPageSize * journalPageSize; start < off+int64(len(p)); start += journalPageSize {
+		if b.err != nil {
+			return
+		}
+		page, ok := b.pages[start]
+		if !ok {
+			page = make([]byte, minInt64(journalPageSize, b.Size()-start))
+			b.err = b.blob.ReadAt(page, start)
+			b.pages[start] = page
+		}
+		from, to := maxInt64(start, off), minInt64(start+int64(len(page)), off+int64(len(p)))
+		copy(page[from-start:], p[from-off:to-off])
+	}
+}
+
+//Sync commits the pages, unless there was an error.
+func (b *journalBlob) Sync() {
+	if b.err == nil {
+		b.err = b.j.commit(b)
+	}
+}
+
+func (b *journalBlob) Close() {
+	b.Sync()
+	if err := b.blob.Close(); b.err == nil {
+		b.err = err
+	}
+}
@@ -0,0 +1,248 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	path := ".TestJournal"
+	os.RemoveAll(path)
+	os.MkdirAll(path, 0777)
+	defer os.RemoveAll(path)
+	lve := NewMemLVE()
+	lv := MustLV(lve)
+	defer lv.Close()
+	j, err := openJournal(path+"/journal", lve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	size := int64(journalPageSize*2 + 100)
+	b, _ := lve.New([]byte{1}, size)
+	blob := j.wrap([]byte{1}, b)
+	data := []byte{1, 2, 3, 4}
+	blob.WriteAt(data, journalPageSize-2)
+	out := make([]byte, 4)
+	blob.ReadAt(out, journalPageSize-2)
+	if !bytes.Equal(out, data) {
+		t.Error("pending write not read:", out)
+	}
+	raw := lv.Get([]byte{1}, size)
+	raw.ReadAt(out, journalPageSize-2)
+	if !bytes.Equal(out, make([]byte, 4)) {
+		t.Error("write reached the blob before Sync:", out)
+	}
+	blob.Sync()
+	raw.ReadAt(out, journalPageSize-2)
+	if !bytes.Equal(out, data) {
+		t.Error("write not in the blob after Sync:", out)
+	}
+	raw.Close()
+	blob.Close()
+	if fi, err := os.Stat(path + "/journal"); err != nil || fi.Size() != 0 {
+		t.Error("journal not cleared:", fi, err)
+	}
+
+	//the first error is kept, and nothing is written after it
+	b, _ = lve.New([]byte{2}, size)
+	blob = j.wrap([]byte{2}, failingBlob{b})
+	blob.WriteAt(data, 0)
+	blob.Close()
+	if blob.err == nil {
+		t.Error("read error not kept")
+	}
+	raw = lv.Get([]byte{2}, size)
+	raw.ReadAt(out, 0)
+	raw.Close()
+	if !bytes.Equal(out, make([]byte, 4)) {
+		t.Error("written after an error:", out)
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	path := ".TestJournalReplay"
+	os.RemoveAll(path)
+	os.MkdirAll(path, 0777)
+	defer os.RemoveAll(path)
+	lve := NewMemLVE()
+	lv := MustLV(lve)
+	defer lv.Close()
+	size := int64(journalPageSize + 10)
+	lv.New([]byte{1}, size).Close()
+
+	//a crash after the journal is synced, before the blob is written
+	raw, _ := lve.Get([]byte{1}, size)
+	b := &journalBlob{blob: raw, key: []byte{1}, pages: make(map[int64][]byte)}
+	b.WriteAt([]byte{5, 6}, journalPageSize+8)
+	record := journalRecord([]*journalBlob{b})
+	b.blob.Close()
+
+	replay := func(record []byte) []byte {
+		err := ioutil.WriteFile(path+"/journal", record, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j, err := openJournal(path+"/journal", lve)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j.Close()
+		if fi, err := os.Stat(path + "/journal"); err != nil || fi.Size() != 0 {
+			t.Error("journal not cleared:", fi, err)
+		}
+		out := make([]byte, 2)
+		blob := lv.Get([]byte{1}, size)
+		blob.ReadAt(out, journalPageSize+8)
+		blob.Close()
+		return out
+	}
+	if out := replay(record[:len(record)-1]); !bytes.Equal(out, []byte{0, 0}) {
+		t.Error("torn record replayed:", out)
+	}
+	record[len(record)-1] ^= 1
+	if out := replay(record); !bytes.Equal(out, []byte{0, 0}) {
+		t.Error("bad checksum replayed:", out)
+	}
+	record[len(record)-1] ^= 1
+	if out := replay(record); !bytes.Equal(out, []byte{5, 6}) {
+		t.Error("record not replayed:", out)
+	}
+
+	//a corrupt record is dropped, after the records before it
+	raw, _ = lve.Get([]byte{1}, size)
+	b = &journalBlob{blob: raw, key: []byte{1}, pages: make(map[int64][]byte)}
+	b.WriteAt([]byte{7, 8}, journalPageSize+8)
+	record2 := journalRecord([]*journalBlob{b})
+	b.blob.Close()
+	body := []byte{0xff, 0xff}
+	bad := make([]byte, 8, 8+len(body))
+	binary.LittleEndian.PutUint32(bad, uint32(len(body)))
+	binary.LittleEndian.PutUint32(bad[4:], crc32.ChecksumIEEE(body))
+	bad = append(bad, body...)
+	if out := replay(append(record2, bad...)); !bytes.Equal(out, []byte{7, 8}) {
+		t.Error("record before a corrupt one not replayed:", out)
+	}
+
+	//blobs deleted after the journal are skipped
+	lv.Delete([]byte{1}, size)
+	err := ioutil.WriteFile(path+"/journal", record, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := openJournal(path+"/journal", lve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+}
+
+func TestJournalGroupCommit(t *testing.T) {
+	path := ".TestJournalGroupCommit"
+	os.RemoveAll(path)
+	os.MkdirAll(path, 0777)
+	defer os.RemoveAll(path)
+	lve := NewMemLVE()
+	lv := MustLV(lve)
+	defer lv.Close()
+	j, err := openJournal(path+"/journal", lve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	var wg sync.WaitGroup
+	for k := byte(0); k < 20; k++ {
+		b, _ := lve.New([]byte{k}, journalPageSize*2)
+		wg.Add(1)
+		go func(k byte, blob *journalBlob) {
+			defer wg.Done()
+			for i := int64(0); i < 10; i++ {
+				blob.WriteAt([]byte{k, byte(i)}, i*300)
+				blob.Sync()
+			}
+			blob.Close()
+			if blob.err != nil {
+				t.Error(blob.err)
+			}
+		}(k, j.wrap([]byte{k}, b))
+	}
+	wg.Wait()
+	out := make([]byte, 2)
+	for k := byte(0); k < 20; k++ {
+		raw := lv.Get([]byte{k}, journalPageSize*2)
+		for i := int64(0); i < 10; i++ {
+			raw.ReadAt(out, i*300)
+			if !bytes.Equal(out, []byte{k, byte(i)}) {
+				t.Error("blob", k, "write", i, "lost:", out)
+			}
+		}
+		raw.Close()
+	}
+	if fi, err := os.Stat(path + "/journal"); err != nil || fi.Size() != 0 {
+		t.Error("journal not cleared:", fi, err)
+	}
+}
+
+//failingWriteBlob is a blob that can't be written.
+type failingWriteBlob struct {
+	BlobE
+}
+
+func (f failingWriteBlob) WriteAt(b []byte, off int64) error {
+	return errors.New("bad sector")
+}
+
+func TestJournalApplyError(t *testing.T) {
+	path := ".TestJournalApplyError"
+	os.RemoveAll(path)
+	os.MkdirAll(path, 0777)
+	defer os.RemoveAll(path)
+	lve := NewMemLVE()
+	lv := MustLV(lve)
+	defer lv.Close()
+	j, err := openJournal(path+"/journal", lve)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := int64(journalPageSize)
+	a, _ := lve.New([]byte{1}, size)
+	blobA := j.wrap([]byte{1}, failingWriteBlob{a})
+	blobA.WriteAt([]byte{1, 2}, 0)
+	blobA.Close()
+	if blobA.err == nil {
+		t.Fatal("write error not reported")
+	}
+	b, _ := lve.New([]byte{2}, size)
+	blobB := j.wrap([]byte{2}, b)
+	blobB.WriteAt([]byte{3, 4}, 0)
+	blobB.Close()
+	if blobB.err != nil {
+		t.Fatal(blobB.err)
+	}
+	j.Close()
+
+	//the record of a is kept after the record of b, and replayed on open
+	j, err = openJournal(path+"/journal", lve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	out := make([]byte, 2)
+	for k, expect := range map[byte][]byte{1: {1, 2}, 2: {3, 4}} {
+		raw := lv.Get([]byte{k}, size)
+		raw.ReadAt(out, 0)
+		raw.Close()
+		if !bytes.Equal(out, expect) {
+			t.Error("blob", k, "unexpected:", out)
+		}
+	}
+}
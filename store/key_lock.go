@@ -0,0 +1,43 @@
+package store
+
+import (
+	"sync"
+)
+
+//keyLocks locks by key, so calls on one file are serialized while calls on
+//others run. Its zero value is ready to use.
+type keyLocks struct {
+	mu sync.Mutex
+	m  map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	users int //holding or waiting
+}
+
+func (l *keyLocks) lock(key []byte) {
+	l.mu.Lock()
+	if l.m == nil {
+		l.m = make(map[string]*keyLock)
+	}
+	k, ok := l.m[string(key)]
+	if !ok {
+		k = &keyLock{}
+		l.m[string(key)] = k
+	}
+	k.users++
+	l.mu.Unlock()
+	k.Lock()
+}
+
+func (l *keyLocks) unlock(key []byte) {
+	l.mu.Lock()
+	k := l.m[string(key)]
+	k.users--
+	if k.users == 0 {
+		delete(l.m, string(key))
+	}
+	l.mu.Unlock()
+	k.Unlock()
+}
@@ -1,14 +1,19 @@
 package store
 
 import (
+	"bytes"
+	"sync"
+
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 //kvl is a KV backed by leveldb
 type kvl struct {
 	db *leveldb.DB
 	ro *opt.ReadOptions
+	mu sync.Mutex //guards b
 	b  *leveldb.Batch
 }
 
@@ -37,16 +42,26 @@ func (kv *kvl) Get(key []byte) []byte {
 }
 
 func (kv *kvl) Set(key []byte, v []byte) {
+	kv.mu.Lock()
 	kv.b.Put(key, v)
+	kv.mu.Unlock()
 }
 
 func (kv *kvl) Delete(key []byte) {
+	kv.mu.Lock()
 	kv.b.Delete(key)
+	kv.mu.Unlock()
 }
 
 var kvlSync opt.WriteOptions = opt.WriteOptions{Sync: true}
 
 func (kv *kvl) Sync() {
+	kv.mu.Lock()
+	kv.sync()
+	kv.mu.Unlock()
+}
+
+func (kv *kvl) sync() {
 	err := kv.db.Write(kv.b, &kvlSync)
 	if err != nil {
 		panic(err)
@@ -59,6 +74,63 @@ func (kv *kvl) Close() error {
 	return kv.db.Close()
 }
 
+//kvlGCBatch is the number of deletes GC collects before writing them.
+const kvlGCBatch = 256
+
+//GC reads from a snapshot, so it does not block Get or Set while f is
+//running. A key is only deleted if it still has the value f saw, so a key Set
+//while GC is running is kept.
 func (kv *kvl) GC(startAfterKey []byte, f func(key []byte, v []byte) (delete bool, stop bool)) {
-	//todo
+	var r *util.Range
+	if startAfterKey != nil {
+		r = &util.Range{Start: startAfterKey}
+	}
+	it := kv.db.NewIterator(r, kv.ro)
+	defer it.Release()
+	var keys, values [][]byte
+	stop := false
+	for !stop && it.Next() {
+		if startAfterKey != nil && bytes.Equal(it.Key(), startAfterKey) {
+			continue
+		}
+		key := append([]byte(nil), it.Key()...)
+		v := append([]byte(nil), it.Value()...)
+		var del bool
+		del, stop = f(key, v)
+		if del {
+			keys = append(keys, key)
+			values = append(values, v)
+			if len(keys) == kvlGCBatch {
+				kv.gcDelete(keys, values)
+				keys, values = keys[:0], values[:0]
+			}
+		}
+	}
+	err := it.Error()
+	if err != nil {
+		panic(err)
+	}
+	kv.gcDelete(keys, values)
+}
+
+//gcDelete deletes keys that still have values. Pending changes in kv.b are not
+//written, they are written after these deletes by the next Sync, so a key Set
+//again is kept.
+func (kv *kvl) gcDelete(keys, values [][]byte) {
+	if len(keys) == 0 {
+		return
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	b := new(leveldb.Batch)
+	for i, key := range keys {
+		v, err := kv.db.Get(key, kv.ro)
+		if err == nil && bytes.Equal(v, values[i]) {
+			b.Delete(key)
+		}
+	}
+	err := kv.db.Write(b, &kvlSync)
+	if err != nil {
+		panic(err)
+	}
 }
@@ -34,3 +34,100 @@ func testKL(kv KV, t *testing.T) {
 		t.Error("deleted value not removed")
 	}
 }
+
+func TestKVLGC(t *testing.T) {
+	path := ".TestKVLGC"
+	os.RemoveAll(path)
+	kv, err := OpenLeveldb(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	defer kv.Close()
+	testKVGC(kv, t)
+
+	//pending changes are not written by GC, and win over its deletes
+	k := []byte{0, 1}
+	kv.Set(k, []byte{8})
+	kv.GC(nil, func(key []byte, v []byte) (bool, bool) {
+		return true, false
+	})
+	if _, err := kv.(*kvl).db.Get(k, nil); err == nil {
+		t.Fatal("pending change written by GC")
+	}
+	kv.Sync()
+	if v := kv.Get(k); len(v) != 1 || v[0] != 8 {
+		t.Fatal("pending change lost", v)
+	}
+}
+
+func testKVGC(kv KV, t *testing.T) {
+	n := 1000
+	for i := 0; i < n; i++ {
+		kv.Set([]byte{byte(i >> 8), byte(i)}, []byte{byte(i % 3)})
+	}
+	kv.Sync()
+	//delete values of 0, stop at key 500 then resume
+	var last []byte
+	seen := 0
+	f := func(key []byte, v []byte) (bool, bool) {
+		if last != nil && bytes.Compare(key, last) <= 0 {
+			t.Fatalf("key %v after %v", key, last)
+		}
+		last = key
+		seen++
+		return v[0] == 0, key[0] == 1 && key[1] == 244
+	}
+	kv.GC(nil, f)
+	if seen != 501 {
+		t.Fatalf("stopped after %v keys", seen)
+	}
+	if len(kv.Get([]byte{0, 3})) != 0 || len(kv.Get([]byte{3, 0xe7})) == 0 {
+		t.Fatal("deleted after stop")
+	}
+	kv.GC(last, f)
+	if seen != n {
+		t.Fatalf("resumed to %v keys", seen)
+	}
+	for i := 0; i < n; i++ {
+		v := kv.Get([]byte{byte(i >> 8), byte(i)})
+		if (len(v) == 0) != (i%3 == 0) {
+			t.Fatalf("key %v is %v", i, v)
+		}
+	}
+
+	//writes during GC
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < n; i++ {
+			kv.Set([]byte{9, byte(i >> 8), byte(i)}, []byte{0})
+			if i%100 == 0 {
+				kv.Sync()
+			}
+		}
+		kv.Sync()
+		close(done)
+	}()
+	kv.GC(nil, func(key []byte, v []byte) (bool, bool) {
+		if key[0] == 0 {
+			//changed after GC has seen it, must be kept
+			kv.Set(key, []byte{7})
+			kv.Sync()
+		}
+		return true, false
+	})
+	<-done
+	if v := kv.Get([]byte{0, 1}); len(v) != 1 || v[0] != 7 {
+		t.Fatal("changed value deleted")
+	}
+	kept := 0
+	kv.GC(nil, func(key []byte, v []byte) (bool, bool) {
+		if key[0] == 9 {
+			kept++
+		}
+		return false, false
+	})
+	if kept == 0 {
+		t.Fatal("no concurrent writes finished")
+	}
+}
@@ -0,0 +1,102 @@
+package store
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+//memKV is a KV kept in memory. Like kvl, Set and Delete are only seen by Get
+//after Sync.
+type memKV struct {
+	mu      sync.Mutex
+	data    map[string][]byte
+	pending map[string][]byte //changes before Sync, nil values to delete
+}
+
+//NewMemKV creates an empty KV in memory, it's lost after Close.
+func NewMemKV() KV {
+	return &memKV{
+		data:    make(map[string][]byte),
+		pending: make(map[string][]byte),
+	}
+}
+
+func (kv *memKV) Get(key []byte) []byte {
+	kv.mu.Lock()
+	v := kv.data[string(key)]
+	kv.mu.Unlock()
+	if v == nil {
+		return nil
+	}
+	return append([]byte(nil), v...)
+}
+
+func (kv *memKV) Set(key []byte, v []byte) {
+	kv.mu.Lock()
+	kv.pending[string(key)] = append([]byte{}, v...)
+	kv.mu.Unlock()
+}
+
+func (kv *memKV) Delete(key []byte) {
+	kv.mu.Lock()
+	kv.pending[string(key)] = nil
+	kv.mu.Unlock()
+}
+
+func (kv *memKV) Sync() {
+	kv.mu.Lock()
+	kv.sync()
+	kv.mu.Unlock()
+}
+
+func (kv *memKV) sync() {
+	for k, v := range kv.pending {
+		if v == nil {
+			delete(kv.data, k)
+		} else {
+			kv.data[k] = v
+		}
+	}
+	kv.pending = make(map[string][]byte)
+}
+
+func (kv *memKV) Close() error {
+	kv.Sync()
+	return nil
+}
+
+//GC works on a copy of the keys, and like kvl, only deletes keys that still
+//have the value f saw.
+func (kv *memKV) GC(startAfterKey []byte, f func(key []byte, v []byte) (delete bool, stop bool)) {
+	kv.mu.Lock()
+	keys := make([]string, 0, len(kv.data))
+	for k := range kv.data {
+		if startAfterKey == nil || k > string(startAfterKey) {
+			keys = append(keys, k)
+		}
+	}
+	kv.mu.Unlock()
+	sort.Strings(keys)
+	for _, k := range keys {
+		kv.mu.Lock()
+		v, ok := kv.data[k]
+		kv.mu.Unlock()
+		if !ok {
+			continue //deleted since
+		}
+		v = append([]byte(nil), v...)
+		del, stop := f([]byte(k), v)
+		if del {
+			kv.mu.Lock()
+			kv.sync() //so that all Set before now are seen
+			if bytes.Equal(kv.data[k], v) {
+				delete(kv.data, k)
+			}
+			kv.mu.Unlock()
+		}
+		if stop {
+			return
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package store
+
+import (
+	"testing"
+)
+
+func TestMemKV(t *testing.T) {
+	kv := NewMemKV()
+	testKL(kv, t)
+	kv.Set([]byte{2}, []byte{3})
+	if kv.Get([]byte{2}) != nil {
+		t.Error("Set seen before Sync")
+	}
+	kv.Sync()
+	kv.Delete([]byte{2})
+	if len(kv.Get([]byte{2})) != 1 {
+		t.Error("Delete seen before Sync")
+	}
+	kv.Close()
+}
+
+func TestMemKVGC(t *testing.T) {
+	kv := NewMemKV()
+	defer kv.Close()
+	testKVGC(kv, t)
+}
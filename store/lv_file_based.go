@@ -1,77 +1,504 @@
 package store
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/xiegeo/fensan/bitset"
 )
 
 type folderLV struct {
 	root       string
 	permission os.FileMode
+	salt       []byte //nil for the layout from before salts
+	mmap       bool
+	mu         sync.Mutex
+	mapped     map[string]int //number of open blobs mapping each file
 }
 
+const (
+	saltFile          = "/salt"
+	saltMigratingFile = "/salt.migrating"
+	saltSize          = 32
+	resizeMarker      = ".resize" //after a file name, while Move resizes it
+)
+
+//OpenFolderLV is OpenFolderLVE that panics on errors.
 func OpenFolderLV(root string) LV {
-	return &folderLV{root, 0777}
+	lv, err := OpenFolderLVE(root)
+	if err != nil {
+		panic(err)
+	}
+	return MustLV(lv)
 }
 
-func (f *folderLV) New(key []byte, size int64) Blob {
-	folder, file := byteToFile(f.root, key, size)
-	os.MkdirAll(folder, f.permission)
-	fi, err := os.Stat(file)
+//OpenFolderLVE opens a LVE that keeps each blob in a file under root.
+//
+//A new store gets a secret salt, used to hash keys to folders, so that clients
+//can't make keys that all go to the same folder. A store from before salts
+//keeps using the first bytes of keys, until changed by RelayoutFolderLV.
+func OpenFolderLVE(root string) (LVE, error) {
+	f, err := openFolderLV(root, false)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+//OpenMmapFolderLV is OpenFolderLV with blobs mapped to memory, for blobs that
+//are read often in small parts, such as bitsets. Blobs that are open can't be
+//moved or deleted.
+func OpenMmapFolderLV(root string) LV {
+	lv, err := openFolderLV(root, true)
+	if err != nil {
+		panic(err)
+	}
+	return MustLV(lv)
+}
+
+func openFolderLV(root string, mmap bool) (*folderLV, error) {
+	f := &folderLV{root: root, permission: 0777, mmap: mmap, mapped: make(map[string]int)}
+	salt, err := f.openSalt()
+	if err != nil {
+		return nil, err
+	}
+	f.salt = salt
+	return f, nil
+}
+
+func (f *folderLV) openSalt() ([]byte, error) {
+	_, err := os.Stat(f.root + saltMigratingFile)
+	if err == nil {
+		return nil, fmt.Errorf("%v: relayout not finished, run it again", f.root)
+	}
+	salt, err := ioutil.ReadFile(f.root + saltFile)
+	if err == nil {
+		if len(salt) != saltSize {
+			return nil, fmt.Errorf("%v: salt of %v bytes, expect %v", f.root, len(salt), saltSize)
+		}
+		return salt, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	old, err := hasFolders(f.root)
+	if err != nil || old {
+		return nil, err
+	}
+	return newSalt(f.root, saltFile, f.permission)
+}
+
+//hasFolders returns true if root has blobs in the layout from before salts.
+func hasFolders(root string) (bool, error) {
+	fis, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, fi := range fis {
+		if fi.IsDir() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//newSalt creates a random salt saved in root+name.
+func newSalt(root string, name string, permission os.FileMode) ([]byte, error) {
+	err := os.MkdirAll(root, permission)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, saltSize)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	file := root + name
+	err = ioutil.WriteFile(file+".new", salt, 0666)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Rename(file+".new", file)
+	if err != nil {
+		return nil, err
+	}
+	return salt, syncFolder(root)
+}
+
+//RelayoutFolderLV moves the blobs of a store from before salts to a new salted
+//layout, and returns the number of blobs moved. The store must not be open.
+//If it's stopped, run it again to finish, as the store can't be opened before.
+func RelayoutFolderLV(root string) (moved int, err error) {
+	salt, err := ioutil.ReadFile(root + saltMigratingFile)
+	if os.IsNotExist(err) {
+		_, err = os.Stat(root + saltFile)
+		if err == nil {
+			return 0, nil //already salted
+		}
+		salt, err = newSalt(root, saltMigratingFile, 0777)
+	}
+	if err != nil {
+		return 0, err
+	}
+	f := &folderLV{root: root, permission: 0777, salt: salt}
+	b1s, err := ioutil.ReadDir(root)
 	if err != nil {
-		if os.IsNotExist(err) {
-			newFile, err := os.Create(file)
+		return 0, err
+	}
+	for _, b1 := range b1s {
+		if !b1.IsDir() {
+			continue
+		}
+		b2s, err := ioutil.ReadDir(root + "/" + b1.Name())
+		if err != nil {
+			return moved, err
+		}
+		for _, b2 := range b2s {
+			if !b2.IsDir() {
+				continue
+			}
+			folder := root + "/" + b1.Name() + "/" + b2.Name()
+			n, err := f.relayoutFolder(folder)
+			moved += n
 			if err != nil {
-				panic(err)
+				return moved, err
 			}
-			newFile.Truncate(size)
-			return NewBlobFromFile(newFile, size)
-		} else {
-			panic(err)
+			os.Remove(folder) //only if empty
+		}
+		os.Remove(root + "/" + b1.Name())
+	}
+	err = os.Rename(root+saltMigratingFile, root+saltFile)
+	if err != nil {
+		return moved, err
+	}
+	return moved, syncFolder(root)
+}
+
+//relayoutFolder moves the blobs in folder to where they should be.
+func (f *folderLV) relayoutFolder(folder string) (moved int, err error) {
+	fis, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return 0, err
+	}
+	for _, fi := range fis {
+		key, size, ok := fileToByte(fi.Name())
+		if !ok || fi.IsDir() {
+			continue
+		}
+		newFolder, newFile := f.byteToFile(key, size)
+		if newFolder == folder {
+			continue
+		}
+		err = os.MkdirAll(newFolder, f.permission)
+		if err != nil {
+			return moved, err
+		}
+		err = os.Rename(folder+"/"+fi.Name(), newFile)
+		if err != nil {
+			return moved, err
+		}
+		err = os.Rename(folder+"/"+fi.Name()+resizeMarker, newFile+resizeMarker)
+		if err != nil && !os.IsNotExist(err) {
+			return moved, err
 		}
+		err = syncFolder(newFolder)
+		if err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, syncFolder(folder)
+}
+
+func (f *folderLV) New(key []byte, size int64) (BlobE, error) {
+	folder, file := f.byteToFile(key, size)
+	err := os.MkdirAll(folder, f.permission)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		newFile, err := os.Create(file)
+		if err != nil {
+			return nil, err
+		}
+		err = newFile.Truncate(size)
+		if err != nil {
+			newFile.Close()
+			return nil, err
+		}
+		f.mapFile(file, false) //no error without resize
+		return f.blob(newFile, size)
 	} else if fi.Size() == 0 {
 		//if it crashed last time between Create and Truncate
-		os.Truncate(file, size)
+		err = os.Truncate(file, size)
+		if err != nil {
+			return nil, err
+		}
 		return f.get(file, size)
 	} else if fi.Size() == size {
-		return nil
-	} else {
-		panic(fmt.Errorf("%v != %v", fi.Size(), size))
+		return nil, nil
 	}
+	return nil, fmt.Errorf("%v: %v != %v", file, fi.Size(), size)
 }
 
-func (f *folderLV) Get(key []byte, size int64) Blob {
-	_, file := byteToFile(f.root, key, size)
+func (f *folderLV) Get(key []byte, size int64) (BlobE, error) {
+	_, file := f.byteToFile(key, size)
 	return f.get(file, size)
 }
 
-func (f *folderLV) get(file string, size int64) Blob {
+func (f *folderLV) get(file string, size int64) (BlobE, error) {
 	opened, err := os.OpenFile(file, os.O_RDWR, f.permission)
 	if os.IsNotExist(err) {
-		return nil
+		return nil, nil
 	}
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	fi, err := opened.Stat()
+	if err != nil {
+		opened.Close()
+		return nil, err
 	}
-	fi, _ := opened.Stat()
 	diskSize := fi.Size()
 	if diskSize == 0 {
-		return nil
+		opened.Close()
+		return nil, nil
 	}
 	if diskSize != size {
-		panic("wrong size")
+		_, err = os.Stat(file + resizeMarker)
+		if err != nil {
+			opened.Close()
+			return nil, fmt.Errorf("%v: %v != %v", file, diskSize, size)
+		}
+	}
+	err = f.mapFile(file, diskSize != size)
+	if err != nil {
+		opened.Close()
+		return nil, err
 	}
-	return NewBlobFromFile(opened, size)
+	if diskSize != size {
+		//a Move crashed before resizing
+		log.Println("resizing", file, "from", diskSize, "to", size,
+			"this should only happen after a crash")
+		err = f.resize(opened, size)
+		if err != nil {
+			opened.Close()
+			f.unmapFile(file)
+			return nil, err
+		}
+	}
+	return f.blob(opened, size)
+}
+
+//blob returns the blob of file, after mapFile.
+func (f *folderLV) blob(file *os.File, size int64) (BlobE, error) {
+	if !f.mmap {
+		return bitset.NewBlobEFromFile(file, size), nil
+	}
+	name := file.Name()
+	b, err := bitset.NewMmapBlobE(file, size)
+	if err != nil {
+		file.Close()
+		f.unmapFile(name)
+		return nil, err
+	}
+	return bitset.OnClose(b, func() { f.unmapFile(name) }), nil
+}
+
+//mapFile counts a blob mapping file, before it is mapped. Mapped files are not
+//resized or deleted, as the memory past the end of a file faults, so an error
+//is returned if file needs resizing but is mapped.
+func (f *folderLV) mapFile(file string, resize bool) error {
+	if !f.mmap {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if resize && f.mapped[file] > 0 {
+		return fmt.Errorf("%v is mapped to memory, can't resize", file)
+	}
+	f.mapped[file]++
+	return nil
+}
+
+func (f *folderLV) unmapFile(file string) {
+	if !f.mmap {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mapped[file]--
+	if f.mapped[file] == 0 {
+		delete(f.mapped, file)
+	}
+}
+
+//lockUnmapped locks mapFile, so files can be resized or deleted if they are
+//not mapped. It returns an error, without locking, if any is mapped.
+func (f *folderLV) lockUnmapped(files ...string) error {
+	if !f.mmap {
+		return nil
+	}
+	f.mu.Lock()
+	for _, file := range files {
+		if f.mapped[file] > 0 {
+			f.mu.Unlock()
+			return fmt.Errorf("%v is mapped to memory", file)
+		}
+	}
+	return nil
 }
 
+func (f *folderLV) unlockUnmapped() {
+	if f.mmap {
+		f.mu.Unlock()
+	}
+}
+
+//Move links the file to the new key, then removes the old key and resizes it.
+//A crash can leave both keys on the same file, which the next Move of it
+//finishes. A crash before resizing is fixed the next time it is opened, as
+//the size is part of the file name, and a marker file allows the resize.
+//Other files of the wrong size are errors.
 func (f *folderLV) Move(oldKey []byte, oldSize int64, newKey []byte, newSize int64) error {
-	panic("not implemented")
+	if newSize <= 0 {
+		return fmt.Errorf("move to size %v", newSize)
+	}
+	oldFolder, oldFile := f.byteToFile(oldKey, oldSize)
+	newFolder, newFile := f.byteToFile(newKey, newSize)
+	err := f.lockUnmapped(oldFile, newFile)
+	if err != nil {
+		return err
+	}
+	defer f.unlockUnmapped()
+	fi, err := os.Stat(oldFile)
+	if err != nil {
+		return err
+	}
+	if fi.Size() != oldSize {
+		return fmt.Errorf("move from %v of size %v, expect %v", oldFile, fi.Size(), oldSize)
+	}
+	err = os.MkdirAll(newFolder, f.permission)
+	if err != nil {
+		return err
+	}
+	if newSize != oldSize {
+		err = writeMarker(newFolder, newFile+resizeMarker)
+		if err != nil {
+			return err
+		}
+	}
+	//unlike rename, link fails if newFile exists, even if an other move made it
+	err = os.Link(oldFile, newFile)
+	if os.IsExist(err) {
+		nfi, err2 := os.Stat(newFile)
+		if err2 != nil || !os.SameFile(fi, nfi) {
+			if newSize != oldSize {
+				os.Remove(newFile + resizeMarker)
+			}
+			return fmt.Errorf("move to %v, which already exist", newFile)
+		}
+		err = nil //linked before a crash
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Remove(oldFile)
+	if err != nil {
+		return err
+	}
+	err = syncFolder(newFolder)
+	if err != nil {
+		return err
+	}
+	if oldFolder != newFolder {
+		err = syncFolder(oldFolder)
+		if err != nil {
+			return err
+		}
+	}
+	if newSize != oldSize {
+		file, err := os.OpenFile(newFile, os.O_RDWR, f.permission)
+		if err != nil {
+			return err
+		}
+		err = f.resize(file, newSize)
+		err2 := file.Close()
+		if err == nil {
+			err = err2
+		}
+		return err
+	}
+	return nil
+}
+
+//writeMarker creates the empty file marker in folder, and syncs it before
+//what it marks is done.
+func writeMarker(folder, marker string) error {
+	m, err := os.Create(marker)
+	if err != nil {
+		return err
+	}
+	err = m.Close()
+	if err != nil {
+		return err
+	}
+	return syncFolder(folder)
+}
+
+//resize truncates file to size, syncs it, then removes its resize marker.
+func (f *folderLV) resize(file *os.File, size int64) error {
+	err := file.Truncate(size)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Remove(file.Name() + resizeMarker)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+//syncFolder commits changes of the files in folder, such as renames.
+func syncFolder(folder string) error {
+	d, err := os.Open(folder)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	d.Close()
+	return err
 }
 
 func (f *folderLV) Delete(key []byte, size int64) (bool, error) {
-	_, file := byteToFile(f.root, key, size)
-	err := os.Remove(file)
+	_, file := f.byteToFile(key, size)
+	err := f.lockUnmapped(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.unlockUnmapped()
+	err = os.Remove(file)
 	if err == nil {
+		os.Remove(file + resizeMarker) //left by a crashed Move
 		return true, nil
 	} else if os.IsNotExist(err) {
 		return true, err
@@ -85,16 +512,73 @@ func (f *folderLV) Close() error {
 
 const folderKeySize = 2
 
-func byteToFile(root string, key []byte, size int64) (folder string, file string) {
-	ks := make([]byte, folderKeySize) //ks is something from key in folderKeySize bytes
-	if len(key) < folderKeySize {
-		//TODO:key to short, need to extend, just use all zeros for now
+//walk calls fn with the key and size of every blob, until fn returns an error.
+func (f *folderLV) walk(fn func(key []byte, size int64) error) error {
+	b1s, err := ioutil.ReadDir(f.root)
+	if err != nil {
+		return err
+	}
+	for _, b1 := range b1s {
+		if !b1.IsDir() {
+			continue
+		}
+		b2s, err := ioutil.ReadDir(f.root + "/" + b1.Name())
+		if err != nil {
+			return err
+		}
+		for _, b2 := range b2s {
+			if !b2.IsDir() {
+				continue
+			}
+			fis, err := ioutil.ReadDir(f.root + "/" + b1.Name() + "/" + b2.Name())
+			if err != nil {
+				return err
+			}
+			for _, fi := range fis {
+				key, size, ok := fileToByte(fi.Name())
+				if !ok || fi.IsDir() {
+					continue
+				}
+				err = fn(key, size)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (f *folderLV) byteToFile(key []byte, size int64) (folder string, file string) {
+	var ks []byte //ks is something from key in at least folderKeySize bytes
+	if f.salt != nil {
+		m := hmac.New(sha256.New, f.salt)
+		m.Write(key)
+		ks = m.Sum(nil)
+	} else if len(key) < folderKeySize {
+		ks = make([]byte, folderKeySize) //short keys are where they always were
 	} else {
-		ks = key[:folderKeySize]
-		//TODO: "hash" the full key with a salt, so clients can't make just keys of same bucket.
+		ks = key
 	}
 
-	folder = fmt.Sprintf("%s/%x/%x", root, ks[0], ks[1])
+	folder = fmt.Sprintf("%s/%x/%x", f.root, ks[0], ks[1])
 	file = fmt.Sprintf("%s/%x-%x", folder, size, key)
 	return
 }
+
+//fileToByte reverses the file name from byteToFile.
+func fileToByte(name string) (key []byte, size int64, ok bool) {
+	i := strings.IndexByte(name, '-')
+	if i < 0 {
+		return nil, 0, false
+	}
+	size, err := strconv.ParseInt(name[:i], 16, 64)
+	if err != nil {
+		return nil, 0, false
+	}
+	key, err = hex.DecodeString(name[i+1:])
+	if err != nil || fmt.Sprintf("%x-%x", size, key) != name {
+		return nil, 0, false
+	}
+	return key, size, true
+}
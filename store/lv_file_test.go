@@ -2,6 +2,7 @@ package store
 
 import (
 	"bytes"
+	"io/ioutil"
 	"os"
 	"testing"
 )
@@ -36,3 +37,231 @@ func TestLVF(t *testing.T) {
 	lv.Close()
 	os.RemoveAll(path)
 }
+
+func TestLVFMove(t *testing.T) {
+	path := ".TestLVFMove"
+	defer os.RemoveAll(path)
+	lv := OpenFolderLV(path)
+	blob := lv.New([]byte{1, 1}, 8)
+	blob.WriteAt([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 0)
+	blob.Close()
+	lv.New([]byte{3, 3}, 4).Close()
+
+	if err := lv.Move([]byte{2, 2}, 8, []byte{4, 4}, 8); err == nil {
+		t.Error("moved a missing blob")
+	}
+	if err := lv.Move([]byte{1, 1}, 8, []byte{3, 3}, 4); err == nil {
+		t.Error("moved over an existing blob")
+	}
+	if err := lv.Move([]byte{1, 1}, 8, []byte{2, 2}, 12); err != nil {
+		t.Fatal(err)
+	}
+	if lv.Get([]byte{1, 1}, 8) != nil {
+		t.Error("old blob not removed")
+	}
+	out := make([]byte, 12)
+	blob = lv.Get([]byte{2, 2}, 12)
+	blob.ReadAt(out, 0)
+	blob.Close()
+	if !bytes.Equal(out, []byte{1, 2, 3, 4, 5, 6, 7, 8, 0, 0, 0, 0}) {
+		t.Error("unexpected:", out)
+	}
+
+	if err := lv.Move([]byte{2, 2}, 12, []byte{2, 2}, 3); err != nil {
+		t.Fatal(err)
+	}
+	out = make([]byte, 3)
+	blob = lv.Get([]byte{2, 2}, 3)
+	blob.ReadAt(out, 0)
+	blob.Close()
+	if !bytes.Equal(out, []byte{1, 2, 3}) {
+		t.Error("unexpected:", out)
+	}
+
+	//as if it crashed after renaming, before resizing
+	f := asFolderLV(lv)
+	_, from := f.byteToFile([]byte{2, 2}, 3)
+	folder, to := f.byteToFile([]byte{5, 5}, 5)
+	os.MkdirAll(folder, 0777)
+	os.Rename(from, to)
+	if _, err := f.Get([]byte{5, 5}, 5); err == nil {
+		t.Error("resized without a marker")
+	}
+	ioutil.WriteFile(to+resizeMarker, nil, 0666)
+	out = make([]byte, 5)
+	blob = lv.Get([]byte{5, 5}, 5)
+	blob.ReadAt(out, 0)
+	blob.Close()
+	if !bytes.Equal(out, []byte{1, 2, 3, 0, 0}) {
+		t.Error("unexpected:", out)
+	}
+	if _, err := os.Stat(to + resizeMarker); !os.IsNotExist(err) {
+		t.Error("marker not removed", err)
+	}
+
+	//as if it crashed after linking, before removing the old key
+	_, from = f.byteToFile([]byte{5, 5}, 5)
+	folder, to = f.byteToFile([]byte{6, 6}, 5)
+	os.MkdirAll(folder, 0777)
+	os.Link(from, to)
+	if err := lv.Move([]byte{5, 5}, 5, []byte{6, 6}, 5); err != nil {
+		t.Fatal(err)
+	}
+	if lv.Get([]byte{5, 5}, 5) != nil {
+		t.Error("old blob not removed")
+	}
+
+	//only one of concurrent moves to the same key wins
+	errs := make(chan error)
+	for k := byte(10); k < 20; k++ {
+		lv.New([]byte{k}, 4).Close()
+		go func(k byte) {
+			errs <- lv.Move([]byte{k}, 4, []byte{7, 7}, 4)
+		}(k)
+	}
+	moved := 0
+	for k := 10; k < 20; k++ {
+		if <-errs == nil {
+			moved++
+		}
+	}
+	if moved != 1 {
+		t.Error("moves to the same key:", moved)
+	}
+	lv.Close()
+}
+
+func TestLVFSalt(t *testing.T) {
+	path := ".TestLVFSalt"
+	defer os.RemoveAll(path)
+	lv := OpenFolderLV(path)
+	f := asFolderLV(lv)
+	if len(f.salt) != saltSize {
+		t.Fatal("new store has no salt")
+	}
+	folders := make(map[string]bool)
+	for i := 0; i < 8; i++ {
+		key := []byte{1, 1, byte(i)}
+		folder, _ := f.byteToFile(key, 4)
+		folders[folder] = true
+		lv.New(key, 4).Close()
+	}
+	if len(folders) < 2 {
+		t.Error("keys of the same prefix are not spread out")
+	}
+	short, _ := f.byteToFile(nil, 4)
+	if short == path+"/0/0" {
+		t.Error("short key not hashed")
+	}
+	lv = OpenFolderLV(path)
+	g := asFolderLV(lv)
+	if !bytes.Equal(f.salt, g.salt) {
+		t.Error("salt changed after reopen")
+	}
+	for i := 0; i < 8; i++ {
+		blob := lv.Get([]byte{1, 1, byte(i)}, 4)
+		if blob == nil {
+			t.Fatal("blob lost after reopen", i)
+		}
+		blob.Close()
+	}
+}
+
+func TestLVFRelayout(t *testing.T) {
+	path := ".TestLVFRelayout"
+	defer os.RemoveAll(path)
+	old := &folderLV{root: path, permission: 0777}
+	keys := [][]byte{{1}, {1, 1}, {1, 1, 1}, {2, 3, 4}}
+	for i, key := range keys {
+		blob := MustLV(old).New(key, 8)
+		blob.WriteAt([]byte{byte(i)}, 0)
+		blob.Close()
+	}
+	if f := asFolderLV(OpenFolderLV(path)); f.salt != nil {
+		t.Fatal("salt added to a store in the old layout")
+	}
+
+	ioutil.WriteFile(path+saltMigratingFile, make([]byte, saltSize), 0666)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("opened while relayout is not finished")
+			}
+		}()
+		OpenFolderLV(path)
+	}()
+
+	moved, err := RelayoutFolderLV(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved == 0 {
+		t.Error("nothing moved")
+	}
+	lv := OpenFolderLV(path)
+	f := asFolderLV(lv)
+	if !bytes.Equal(f.salt, make([]byte, saltSize)) {
+		t.Error("salt is not the one from the started relayout")
+	}
+	for i, key := range keys {
+		blob := lv.Get(key, 8)
+		if blob == nil {
+			t.Fatal("blob lost", key)
+		}
+		out := make([]byte, 1)
+		blob.ReadAt(out, 0)
+		blob.Close()
+		if out[0] != byte(i) {
+			t.Error("wrong blob", key, out)
+		}
+		if _, file := old.byteToFile(key, 8); fileExists(file) {
+			t.Error("old file left", file)
+		}
+	}
+	moved, err = RelayoutFolderLV(path)
+	if moved != 0 || err != nil {
+		t.Error("relayout again", moved, err)
+	}
+}
+
+func asFolderLV(lv LV) *folderLV {
+	return lv.(mustLV).LVE.(*folderLV)
+}
+
+func fileExists(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
+}
+
+func TestLVFMmap(t *testing.T) {
+	path := ".TestLVFMmap"
+	defer os.RemoveAll(path)
+	lv := OpenMmapFolderLV(path)
+	blob := lv.New([]byte{1}, 8)
+	blob.WriteAt([]byte{3, 4, 5}, 4)
+	blob.Sync()
+	blob.Close()
+
+	blob = OpenFolderLV(path).Get([]byte{1}, 8)
+	out := make([]byte, 8)
+	blob.ReadAt(out, 0)
+	blob.Close()
+	if !bytes.Equal(out, []byte{0, 0, 0, 0, 3, 4, 5, 0}) {
+		t.Error("unexpected:", out)
+	}
+
+	//mapped files are not resized or deleted
+	blob = lv.Get([]byte{1}, 8)
+	if err := lv.Move([]byte{1}, 8, []byte{2}, 4); err == nil {
+		t.Error("moved a mapped blob")
+	}
+	if _, err := lv.Delete([]byte{1}, 8); err == nil {
+		t.Error("deleted a mapped blob")
+	}
+	blob.ReadAt(out, 0)
+	blob.Close()
+	if err := lv.Move([]byte{1}, 8, []byte{2}, 4); err != nil {
+		t.Error("can't move after close:", err)
+	}
+	lv.Close()
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/xiegeo/fensan/bitset"
+)
+
+//memLV is a LV kept in memory, Blobs from it share the same bytes.
+type memLV struct {
+	mu    sync.Mutex
+	blobs map[lvKey][]byte
+}
+
+type lvKey struct {
+	key  string
+	size int64
+}
+
+//NewMemLV creates an empty LV in memory, it's lost after Close.
+func NewMemLV() LV {
+	return MustLV(NewMemLVE())
+}
+
+//NewMemLVE is NewMemLV as a LVE, it never returns errors.
+func NewMemLVE() LVE {
+	return &memLV{blobs: make(map[lvKey][]byte)}
+}
+
+func (m *memLV) New(key []byte, size int64) (BlobE, error) {
+	if size <= 0 {
+		panic(fmt.Errorf("size %v <= 0", size))
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := lvKey{string(key), size}
+	if _, ok := m.blobs[k]; ok {
+		return nil, nil
+	}
+	b := make([]byte, size)
+	m.blobs[k] = b
+	return bitset.NewBlobEFromBytes(b), nil
+}
+
+func (m *memLV) Get(key []byte, size int64) (BlobE, error) {
+	m.mu.Lock()
+	b, ok := m.blobs[lvKey{string(key), size}]
+	m.mu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	return bitset.NewBlobEFromBytes(b), nil
+}
+
+func (m *memLV) Move(oldKey []byte, oldSize int64, newKey []byte, newSize int64) error {
+	if newSize <= 0 {
+		return fmt.Errorf("move to size %v", newSize)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	from, to := lvKey{string(oldKey), oldSize}, lvKey{string(newKey), newSize}
+	b, ok := m.blobs[from]
+	if !ok {
+		return fmt.Errorf("move from %x of size %v: %v", oldKey, oldSize, os.ErrNotExist)
+	}
+	if _, ok := m.blobs[to]; ok {
+		return fmt.Errorf("move to %x of size %v, which already exist", newKey, newSize)
+	}
+	if newSize != oldSize {
+		resized := make([]byte, newSize)
+		copy(resized, b)
+		b = resized
+	}
+	delete(m.blobs, from)
+	m.blobs[to] = b
+	return nil
+}
+
+//Delete reports os.ErrNotExist for missing blobs, as folderLV does.
+func (m *memLV) Delete(key []byte, size int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := lvKey{string(key), size}
+	if _, ok := m.blobs[k]; !ok {
+		return true, os.ErrNotExist
+	}
+	delete(m.blobs, k)
+	return true, nil
+}
+
+func (m *memLV) Close() error {
+	return nil //no-op
+}
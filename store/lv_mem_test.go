@@ -0,0 +1,67 @@
+package store
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMemLV(t *testing.T) {
+	lv := NewMemLV()
+	defer lv.Close()
+	testLV(t, lv)
+}
+
+//testLV tests the semantics every LV should have.
+func testLV(t *testing.T, lv LV) {
+	blob := lv.New([]byte{1}, 8)
+	blob.WriteAt([]byte{3, 4, 5}, 4)
+	blob.Close()
+	if lv.New([]byte{1}, 8) != nil {
+		t.Error("New over an existing blob")
+	}
+	if lv.Get([]byte{1}, 7) != nil {
+		t.Error("got blob of an other size")
+	}
+
+	out := make([]byte, 8)
+	blob = lv.Get([]byte{1}, 8)
+	blob.ReadAt(out, 0)
+	blob.Close()
+	if !bytes.Equal(out, []byte{0, 0, 0, 0, 3, 4, 5, 0}) {
+		t.Error("unexpected:", out)
+	}
+
+	lv.New([]byte{3}, 4).Close()
+	if lv.Move([]byte{2}, 8, []byte{4}, 8) == nil {
+		t.Error("moved a missing blob")
+	}
+	if lv.Move([]byte{1}, 8, []byte{3}, 4) == nil {
+		t.Error("moved over an existing blob")
+	}
+	err := lv.Move([]byte{1}, 8, []byte{2}, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = make([]byte, 6)
+	blob = lv.Get([]byte{2}, 6)
+	blob.ReadAt(out, 0)
+	blob.Close()
+	if !bytes.Equal(out, []byte{0, 0, 0, 0, 3, 4}) {
+		t.Error("unexpected:", out)
+	}
+	if lv.Get([]byte{1}, 8) != nil {
+		t.Error("old blob not removed")
+	}
+
+	d, err := lv.Delete([]byte{2}, 6)
+	if !d || err != nil {
+		t.Error("can't delete", err)
+	}
+	d, err = lv.Delete([]byte{2}, 6)
+	if !d || err == nil {
+		t.Error("deleted a missing blob", err)
+	}
+	if lv.Get([]byte{2}, 6) != nil {
+		t.Error("deleted value not removed")
+	}
+}
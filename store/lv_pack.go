@@ -0,0 +1,416 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/xiegeo/fensan/bitset"
+)
+
+//packLV is a LV that appends blobs to large pack files, so that small blobs
+//don't each take a file. Where each blob is, is kept in an index KV.
+//
+//Space of deleted blobs is freed by compacting, which copies the live blobs
+//of a pack to a new pack, then deletes the old one. A pack is compacted when
+//the fraction of deleted bytes in it reaches compactAt, and none of its blobs
+//are open.
+type packLV struct {
+	mu        sync.Mutex
+	path      string
+	index     KV
+	locs      map[lvKey]packLoc
+	packs     map[uint32]*pack
+	current   *pack //where new blobs are added
+	nextID    uint32
+	maxSize   int64   //a new pack is started when current would be larger
+	compactAt float64 //fraction of deleted bytes
+}
+
+type packLoc struct {
+	pack uint32
+	off  int64
+}
+
+type pack struct {
+	id   uint32
+	f    *os.File
+	size int64
+	live int64 //bytes of blobs in the index
+	open int   //number of open blobs
+}
+
+const (
+	packMaxSize   = 1 << 30
+	packCompactAt = 0.5
+	packLocSize   = 4 + 8
+)
+
+//OpenPackLV is OpenPackLVE wrapped by MustLV.
+func OpenPackLV(path string, index KV) (LV, error) {
+	lv, err := OpenPackLVE(path, index)
+	if err != nil {
+		return nil, err
+	}
+	return MustLV(lv), nil
+}
+
+//OpenPackLVE opens a LVE with pack files in path, and the index in index,
+//such as OpenLeveldb(path + "/index"). index is closed by Close, or when an
+//error is returned.
+//
+//Packs that have no blobs in the index, such as a pack being compacted during
+//a crash, are deleted.
+func OpenPackLVE(path string, index KV) (_ LVE, err error) {
+	defer func() {
+		if err != nil {
+			index.Close()
+		}
+	}()
+	err = os.MkdirAll(path, 0777)
+	if err != nil {
+		return nil, err
+	}
+	lv := &packLV{
+		path:      path,
+		index:     index,
+		locs:      make(map[lvKey]packLoc),
+		packs:     make(map[uint32]*pack),
+		maxSize:   packMaxSize,
+		compactAt: packCompactAt,
+	}
+	defer func() {
+		if err != nil {
+			lv.closePacks()
+		}
+	}()
+	live := make(map[uint32]int64)
+	index.GC(nil, func(k []byte, v []byte) (bool, bool) {
+		if len(k) < 8 || len(v) != packLocSize {
+			err = fmt.Errorf("bad pack index %x: %x", k, v)
+			return false, true
+		}
+		key := lvKey{string(k[8:]), int64(littleEndianUint64(k))}
+		loc := packLoc{littleEndianUint32(v), int64(littleEndianUint64(v[4:]))}
+		lv.locs[key] = loc
+		live[loc.pack] += key.size
+		return false, false
+	})
+	if err != nil {
+		return nil, err
+	}
+	fis, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range fis {
+		var id uint32
+		if _, err := fmt.Sscanf(fi.Name(), "%08x.pack", &id); err != nil || fi.Name() != packName("", id)[1:] {
+			continue
+		}
+		if id >= lv.nextID {
+			lv.nextID = id + 1
+		}
+		if live[id] == 0 {
+			err = os.Remove(packName(path, id))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		f, err := os.OpenFile(packName(path, id), os.O_RDWR, 0666)
+		if err != nil {
+			return nil, err
+		}
+		p := &pack{id: id, f: f, size: fi.Size(), live: live[id]}
+		lv.packs[id] = p
+		if lv.current == nil || id > lv.current.id {
+			lv.current = p
+		}
+	}
+	for key, loc := range lv.locs {
+		p := lv.packs[loc.pack]
+		if p == nil || loc.off+key.size > p.size {
+			return nil, fmt.Errorf("blob %x of size %v is not in pack %v", key.key, key.size, loc.pack)
+		}
+	}
+	return lv, nil
+}
+
+func packName(path string, id uint32) string {
+	return fmt.Sprintf("%s/%08x.pack", path, id)
+}
+
+func packIndexKey(key []byte, size int64) []byte {
+	k := make([]byte, 8, 8+len(key))
+	binary.LittleEndian.PutUint64(k, uint64(size))
+	return append(k, key...)
+}
+
+func packIndexValue(loc packLoc) []byte {
+	v := make([]byte, packLocSize)
+	binary.LittleEndian.PutUint32(v, loc.pack)
+	binary.LittleEndian.PutUint64(v[4:], uint64(loc.off))
+	return v
+}
+
+func (lv *packLV) newPack() (*pack, error) {
+	id := lv.nextID
+	f, err := os.OpenFile(packName(lv.path, id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, err
+	}
+	lv.nextID++
+	p := &pack{id: id, f: f}
+	lv.packs[id] = p
+	return p, nil
+}
+
+//alloc adds size zeros to the end of the current pack.
+func (lv *packLV) alloc(size int64) (*pack, int64, error) {
+	p := lv.current
+	if p == nil || (p.size > 0 && p.size+size > lv.maxSize) {
+		var err error
+		p, err = lv.newPack()
+		if err != nil {
+			return nil, 0, err
+		}
+		lv.current = p
+	}
+	off := p.size
+	err := p.f.Truncate(off + size)
+	if err != nil {
+		return nil, 0, err
+	}
+	p.size += size
+	return p, off, nil
+}
+
+func (lv *packLV) New(key []byte, size int64) (BlobE, error) {
+	if size <= 0 {
+		panic(fmt.Errorf("size %v <= 0", size))
+	}
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+	k := lvKey{string(key), size}
+	if _, ok := lv.locs[k]; ok {
+		return nil, nil
+	}
+	p, off, err := lv.alloc(size)
+	if err != nil {
+		return nil, err
+	}
+	loc := packLoc{p.id, off}
+	lv.index.Set(packIndexKey(key, size), packIndexValue(loc))
+	lv.index.Sync()
+	lv.locs[k] = loc
+	p.live += size
+	return lv.view(p, off, size), nil
+}
+
+func (lv *packLV) Get(key []byte, size int64) (BlobE, error) {
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+	loc, ok := lv.locs[lvKey{string(key), size}]
+	if !ok {
+		return nil, nil
+	}
+	return lv.view(lv.packs[loc.pack], loc.off, size), nil
+}
+
+//packView is a blob in a pack, the pack is not compacted while it's open.
+type packView struct {
+	BlobE
+	lv *packLV
+	p  *pack
+}
+
+func (lv *packLV) view(p *pack, off, size int64) BlobE {
+	p.open++
+	return &packView{bitset.SubBlobE(bitset.NewBlobEFromFile(p.f, p.size), off, size), lv, p}
+}
+
+func (v *packView) Close() error {
+	v.BlobE.Close()
+	v.lv.mu.Lock()
+	defer v.lv.mu.Unlock()
+	p := v.p
+	if p == nil {
+		return nil //closed before
+	}
+	v.p = nil
+	p.open--
+	return v.lv.maybeCompact(p)
+}
+
+func (lv *packLV) Move(oldKey []byte, oldSize int64, newKey []byte, newSize int64) error {
+	if newSize <= 0 {
+		return fmt.Errorf("move to size %v", newSize)
+	}
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+	from, to := lvKey{string(oldKey), oldSize}, lvKey{string(newKey), newSize}
+	loc, ok := lv.locs[from]
+	if !ok {
+		return fmt.Errorf("move from %x of size %v: %v", oldKey, oldSize, os.ErrNotExist)
+	}
+	if _, ok := lv.locs[to]; ok {
+		return fmt.Errorf("move to %x of size %v, which already exist", newKey, newSize)
+	}
+	old := lv.packs[loc.pack]
+	p := old
+	if newSize > oldSize {
+		var off int64
+		var err error
+		p, off, err = lv.alloc(newSize)
+		if err != nil {
+			return err
+		}
+		err = copyPack(p.f, off, old.f, loc.off, oldSize)
+		if err != nil {
+			return err
+		}
+		err = p.f.Sync()
+		if err != nil {
+			return err
+		}
+		loc = packLoc{p.id, off}
+	}
+	lv.index.Delete(packIndexKey(oldKey, oldSize))
+	lv.index.Set(packIndexKey(newKey, newSize), packIndexValue(loc))
+	lv.index.Sync() //both changes are in one batch
+	delete(lv.locs, from)
+	lv.locs[to] = loc
+	old.live -= oldSize
+	p.live += newSize
+	return lv.maybeCompact(old)
+}
+
+//copyPack copies n bytes from src at srcOff to dst at dstOff.
+func copyPack(dst *os.File, dstOff int64, src *os.File, srcOff int64, n int64) error {
+	buf := make([]byte, minInt64(n, 1<<20))
+	for n > 0 {
+		b := buf[:minInt64(n, int64(len(buf)))]
+		_, err := src.ReadAt(b, srcOff)
+		if err != nil {
+			return err
+		}
+		_, err = dst.WriteAt(b, dstOff)
+		if err != nil {
+			return err
+		}
+		srcOff += int64(len(b))
+		dstOff += int64(len(b))
+		n -= int64(len(b))
+	}
+	return nil
+}
+
+//Delete reports os.ErrNotExist for missing blobs, as folderLV does.
+func (lv *packLV) Delete(key []byte, size int64) (bool, error) {
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+	k := lvKey{string(key), size}
+	loc, ok := lv.locs[k]
+	if !ok {
+		return true, os.ErrNotExist
+	}
+	lv.index.Delete(packIndexKey(key, size))
+	lv.index.Sync()
+	delete(lv.locs, k)
+	p := lv.packs[loc.pack]
+	p.live -= size
+	return true, lv.maybeCompact(p)
+}
+
+func (lv *packLV) maybeCompact(p *pack) error {
+	if p.open > 0 || p.size == 0 || float64(p.size-p.live) < lv.compactAt*float64(p.size) {
+		return nil
+	}
+	return lv.compact(p)
+}
+
+//compact copies the live blobs of p to a new pack, and changes the index to
+//it before deleting p, so a crash leaves only one of them in the index.
+func (lv *packLV) compact(p *pack) error {
+	var np *pack
+	if p.live > 0 {
+		var err error
+		np, err = lv.newPack()
+		if err != nil {
+			return err
+		}
+		moved, err := lv.copyLive(np, p)
+		if err != nil {
+			lv.dropPack(np)
+			return err
+		}
+		for k, loc := range moved {
+			lv.index.Set(packIndexKey([]byte(k.key), k.size), packIndexValue(loc))
+			lv.locs[k] = loc
+		}
+		lv.index.Sync()
+		np.live = p.live
+	}
+	if lv.current == p {
+		lv.current = np
+	}
+	return lv.dropPack(p)
+}
+
+//copyLive copies the live blobs of p to the end of np, which is not indexed
+//until they are synced.
+func (lv *packLV) copyLive(np, p *pack) (map[lvKey]packLoc, error) {
+	moved := make(map[lvKey]packLoc)
+	for k, loc := range lv.locs {
+		if loc.pack != p.id {
+			continue
+		}
+		err := np.f.Truncate(np.size + k.size)
+		if err != nil {
+			return nil, err
+		}
+		err = copyPack(np.f, np.size, p.f, loc.off, k.size)
+		if err != nil {
+			return nil, err
+		}
+		moved[k] = packLoc{np.id, np.size}
+		np.size += k.size
+	}
+	return moved, np.f.Sync()
+}
+
+//dropPack closes and removes a pack that has nothing in the index.
+func (lv *packLV) dropPack(p *pack) error {
+	delete(lv.packs, p.id)
+	if lv.current == p {
+		lv.current = nil
+	}
+	err := p.f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(packName(lv.path, p.id))
+}
+
+func (lv *packLV) Close() error {
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+	err := lv.closePacks()
+	if e := lv.index.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func (lv *packLV) closePacks() (err error) {
+	for _, p := range lv.packs {
+		if e := p.f.Close(); err == nil {
+			err = e
+		}
+	}
+	lv.packs = nil
+	return err
+}
@@ -0,0 +1,167 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func openTestPackLV(t *testing.T, path string, index KV) (LV, *packLV) {
+	lv, err := OpenPackLVE(path, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return MustLV(lv), lv.(*packLV)
+}
+
+func countPacks(t *testing.T, path string) int {
+	fis, err := ioutil.ReadDir(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(fis)
+}
+
+func TestPackLV(t *testing.T) {
+	path := ".TestPackLV"
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+	lv, _ := openTestPackLV(t, path, NewMemKV())
+	testLV(t, lv)
+	lv.Close()
+}
+
+func TestPackLVCompact(t *testing.T) {
+	path := ".TestPackLVCompact"
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+	index := NewMemKV()
+	lv, p := openTestPackLV(t, path, index)
+	p.maxSize = 100 * 10
+	for i := 0; i < 200; i++ {
+		blob := lv.New([]byte{byte(i)}, 10)
+		blob.WriteAt([]byte{byte(i)}, 9)
+		blob.Close()
+	}
+	if n := countPacks(t, path); n != 2 {
+		t.Fatalf("%v packs", n)
+	}
+	for i := 0; i < 200; i++ {
+		if i%4 != 0 {
+			lv.Delete([]byte{byte(i)}, 10)
+		}
+	}
+	if n := countPacks(t, path); n != 2 {
+		t.Fatalf("%v packs after compacting", n)
+	}
+	for _, pk := range p.packs {
+		if pk.size != 250 || pk.live != 250 {
+			t.Errorf("pack %v of %v bytes, %v live", pk.id, pk.size, pk.live)
+		}
+	}
+
+	//packs are kept while blobs are open
+	open := lv.Get([]byte{0}, 10)
+	for i := 0; i < 100; i += 4 {
+		lv.Delete([]byte{byte(i)}, 10)
+	}
+	if n := countPacks(t, path); n != 2 {
+		t.Fatalf("%v packs with an open blob", n)
+	}
+	open.Close()
+	if n := countPacks(t, path); n != 1 {
+		t.Fatalf("%v packs after blob closed", n)
+	}
+
+	//closing a blob twice does not let its pack compact under an other
+	blob, _ := p.Get([]byte{100}, 10)
+	blob.Close()
+	open = lv.Get([]byte{104}, 10)
+	blob.Close()
+	for pk := range p.packs {
+		if p.packs[pk].open != 1 {
+			t.Errorf("pack %v open by %v", pk, p.packs[pk].open)
+		}
+	}
+	open.Close()
+
+	//a failed compact leaves no new pack
+	var old *pack
+	for _, pk := range p.packs {
+		old = pk
+	}
+	f := old.f
+	old.f, _ = os.Open(os.DevNull)
+	if err := p.compact(old); err == nil {
+		t.Error("compacted from an unreadable pack")
+	}
+	old.f.Close()
+	old.f = f
+	if n := countPacks(t, path); n != 1 || len(p.packs) != 1 {
+		t.Fatalf("%v packs, %v loaded after failed compact", n, len(p.packs))
+	}
+
+	//a pack left by a crash is removed
+	ioutil.WriteFile(packName(path, 99), make([]byte, 10), 0666)
+	lv.Close()
+	lv, _ = openTestPackLV(t, path, index)
+	if n := countPacks(t, path); n != 1 {
+		t.Fatalf("%v packs after reopen", n)
+	}
+	for i := 0; i < 200; i++ {
+		blob := lv.Get([]byte{byte(i)}, 10)
+		if (blob != nil) != (i >= 100 && i%4 == 0) {
+			t.Fatal("wrong blob", i)
+		}
+		if blob == nil {
+			continue
+		}
+		out := make([]byte, 10)
+		blob.ReadAt(out, 0)
+		blob.Close()
+		if !bytes.Equal(out, append(make([]byte, 9), byte(i))) {
+			t.Fatal("unexpected:", i, out)
+		}
+	}
+	if blob := lv.New([]byte{1}, 10); blob == nil {
+		t.Error("can't add after reopen")
+	} else {
+		blob.Close()
+	}
+	lv.Close()
+}
+
+//closedKV records if it was closed.
+type closedKV struct {
+	KV
+	closed bool
+}
+
+func (kv *closedKV) Close() error {
+	kv.closed = true
+	return kv.KV.Close()
+}
+
+func TestPackLVOpenError(t *testing.T) {
+	path := ".TestPackLVOpenError"
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+	lv, _ := openTestPackLV(t, path, NewMemKV())
+	lv.New([]byte{1}, 10).Close()
+	lv.Close()
+
+	//a blob not in its pack
+	index := &closedKV{KV: NewMemKV()}
+	index.Set(packIndexKey([]byte{1}, 10), packIndexValue(packLoc{0, 100}))
+	index.Sync()
+	if _, err := OpenPackLVE(path, index); err == nil || !index.closed {
+		t.Fatal("index not closed on error", err)
+	}
+	index = &closedKV{KV: NewMemKV()}
+	index.Set([]byte{1}, []byte{1})
+	index.Sync()
+	if _, err := OpenPackLVE(path, index); err == nil || !index.closed {
+		t.Fatal("index not closed on error", err)
+	}
+}
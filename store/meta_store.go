@@ -3,6 +3,8 @@ package store
 import (
 	"bytes"
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/xiegeo/fensan/bitset"
 	ht "github.com/xiegeo/fensan/hashtree"
@@ -11,20 +13,109 @@ import (
 type metaStore struct {
 	minLevel  ht.Level
 	ttlStore  KV
-	hashStore LV
+	hashStore LVE
+	journal   *journal //of hashStore, nil for no journal
+	locks     keyLocks //by hash of file key
 }
 
 const BlobSize = 4 << 20 //4MByte blocks
 const hashSize = ht.HashSize
 
 func OpenMetaStore(path string) (MetaStore, error) {
-	minLevel := ht.Levels(BlobSize / ht.LeafBlockSize) // level 13
+	return openMetaStore(path)
+}
+
+func openMetaStore(path string) (*metaStore, error) {
+	err := checkHashLayout(path)
+	if err != nil {
+		return nil, err
+	}
 	ttlStore, err := OpenLeveldb(path + "/m_ttl")
 	if err != nil {
 		return nil, err
 	}
-	hashStore := OpenFolderLV(path + "/m_hash")
-	return &metaStore{minLevel, ttlStore, hashStore}, nil
+	hashStore, err := openFolderLV(path+"/m_hash", true)
+	if err != nil {
+		ttlStore.Close()
+		return nil, err
+	}
+	journal, err := openJournal(path+"/m_journal", hashStore)
+	if err != nil {
+		ttlStore.Close()
+		hashStore.Close()
+		return nil, err
+	}
+	m := newMetaStore(ttlStore, hashStore)
+	m.journal = journal
+	return m, nil
+}
+
+//hashLayoutFile marks a hash store in the layout of mixedBlobSizes, which keeps
+//the whole tree from minLevel up to the root. Hash blobs from before it only
+//had room for the hashes at minLevel, and nodes above were written over the
+//bitset, so they can't be migrated, only put again.
+const hashLayoutFile = "/m_hash_v2"
+
+//checkHashLayout returns an error for a hash store from before hashLayoutFile,
+//else makes sure the marker is saved before any hash is.
+func checkHashLayout(path string) error {
+	_, err := os.Stat(path + hashLayoutFile)
+	if !os.IsNotExist(err) {
+		return err
+	}
+	old, err := hasFolders(path + "/m_hash")
+	if err != nil {
+		return err
+	}
+	if old {
+		return fmt.Errorf("%v/m_hash is in the layout from before whole hash trees, remove it and put the hashes again", path)
+	}
+	err = os.MkdirAll(path, 0777)
+	if err != nil {
+		return err
+	}
+	return writeMarker(path, path+hashLayoutFile)
+}
+
+//NewMetaStoreOn creates a MetaStore using the given stores, such as the ones
+//from NewMemKV and NewMemLVE.
+func NewMetaStoreOn(ttlStore KV, hashStore LVE) MetaStore {
+	return newMetaStore(ttlStore, hashStore)
+}
+
+func newMetaStore(ttlStore KV, hashStore LVE) *metaStore {
+	minLevel := ht.Levels(BlobSize/ht.LeafBlockSize) - 1 // level 12, hashes of whole blobs
+	migrateTTLEpoch(ttlStore, time.Now())
+	return &metaStore{minLevel: minLevel, ttlStore: ttlStore, hashStore: hashStore}
+}
+
+//ttlEpochKey marks a ttlStore where TTLs use the month epoch of ttlOf. It is
+//not HLKey shaped, so the Collector skips it.
+var ttlEpochKey = []byte("ttl_epoch")
+
+//oldTTLOf is how ttlOf used to count, y - 24000 + (m-1), which is not a count
+//of months. Only used to migrate.
+func oldTTLOf(t time.Time) TTL {
+	y, m, _ := t.UTC().Date()
+	return TTL(y - ttl_base_year*12 + (int(m) - 1))
+}
+
+//migrateTTLEpoch moves TTLs saved with oldTTLOf to the epoch of ttlOf,
+//keeping the months left from now. It is done once, all changes and the
+//marker are written by a single Sync.
+func migrateTTLEpoch(kv KV, now time.Time) {
+	if kv.Get(ttlEpochKey) != nil {
+		return
+	}
+	shift := ttlOf(now) - oldTTLOf(now)
+	kv.GC(nil, func(k []byte, v []byte) (bool, bool) {
+		if len(v) == 2 {
+			kv.Set(k, (TTLFromBytes(v) + shift).Bytes())
+		}
+		return false, false
+	})
+	kv.Set(ttlEpochKey, []byte{1})
+	kv.Sync()
 }
 
 func (m *metaStore) InnerHashMinLevel() ht.Level {
@@ -32,6 +123,16 @@ func (m *metaStore) InnerHashMinLevel() ht.Level {
 }
 
 func (m *metaStore) asserInRange(key HLKey, hs []byte, level ht.Level, off ht.Nodes) (n, lw ht.Nodes, rebased ht.Level) {
+	n, lw = assertHashesInRange(key, hs, level, off)
+	rebased = level - m.minLevel
+	if rebased < 0 {
+		panic("can't request levels lower than min")
+	}
+	return
+}
+
+//assertHashesInRange checks hs can be the hashes of key at level from off.
+func assertHashesInRange(key HLKey, hs []byte, level ht.Level, off ht.Nodes) (n, lw ht.Nodes) {
 	lhs := len(hs)
 	n, r := ht.Nodes(lhs/hashSize), lhs%hashSize
 	if n == 0 {
@@ -41,113 +142,216 @@ func (m *metaStore) asserInRange(key HLKey, hs []byte, level ht.Level, off ht.No
 		panic("hs is not multples of hashes")
 	}
 
-	lw = ht.LevelWidth(ht.I.Nodes(key.GetLength()), level)
-	if off < 0 || off+n >= lw {
-		panic(fmt.Errorf("offset out: %v < 0 || %v + %v >= %v", off, off, n, lw))
+	leafs := ht.I.Nodes(key.GetLength())
+	if level >= ht.Levels(leafs) {
+		panic(fmt.Errorf("level %v is above the root", level))
 	}
-	rebased = level - m.minLevel + 1
-	if rebased < 1 {
-		panic("can't request levels lower than min")
+	lw = ht.LevelWidth(leafs, level)
+	if off < 0 || off+n > lw {
+		panic(fmt.Errorf("offset out: %v < 0 || %v + %v > %v", off, off, n, lw))
 	}
 	return
 }
 
 func (m *metaStore) mixedBlobSizes(key HLKey) (fileBlobs ht.Nodes, blobBytes, hashBytes, treeSize int64) {
-	fileBlobs = ht.LevelWidth(ht.I.Nodes(key.GetLength()), m.minLevel-1)
-	hashBytes = int64(fileBlobs) * hashSize
-	treeSize = ht.HashTreeSize(fileBlobs)
+	fileBlobs = ht.LevelWidth(ht.I.Nodes(key.GetLength()), m.minLevel)
+	blobBytes, hashBytes, treeSize = treeSizes(fileBlobs)
+	return
+}
+
+//treeSizes returns the sizes of the mixed blob of a hashTree of width.
+func treeSizes(width ht.Nodes) (blobBytes, hashBytes, treeSize int64) {
+	treeSize = ht.HashTreeSize(width)
+	hashBytes = treeSize * hashSize
 	blobBytes = hashBytes + (treeSize+7)/8 + bitset.CountBytes
 	return
 }
 
-func (m *metaStore) getHashBlob(key HLKey) (ht.Nodes, Blob, *bitset.CountingBitSet, bitset.Closer) {
-	fileBlobs, blobBytes, hashBytes, treeSize := m.mixedBlobSizes(key)
-	mixed := m.hashStore.Get(key.GetHash(), blobBytes)
-	if mixed == nil {
-		mixed = m.hashStore.New(key.GetHash(), blobBytes)
+//hashTree is a mixed blob of the hashes of a tree, followed by which of them
+//are known. I/O errors are kept by mixed, and returned by Close.
+type hashTree struct {
+	width  ht.Nodes //of the lowest level
+	hashes Blob
+	known  *bitset.CountingBitSet
+	mixed  *journalBlob
+}
+
+//openTree opens the tree of width at key in the hash store, a new tree is
+//created knowing only the root.
+func (m *metaStore) openTree(key []byte, width ht.Nodes, root []byte) (*hashTree, error) {
+	blobBytes, hashBytes, treeSize := treeSizes(width)
+	blob, err := m.hashStore.Get(key, blobBytes)
+	isNew := err == nil && blob == nil
+	if isNew {
+		blob, err = m.hashStore.New(key, blobBytes)
+	}
+	if err != nil {
+		return nil, err
 	}
+	mixed := m.journal.wrap(key, blob)
 	hashes, countingBlob := bitset.SplitBlob(mixed, hashBytes)
 	countingBlob = bitset.MakeFullBuffered(countingBlob)
-	counting := bitset.NewCounting(countingBlob, int(treeSize))
-	return fileBlobs, hashes, counting, mixed
+	t := &hashTree{width, hashes, bitset.NewCounting(countingBlob, int(treeSize)), mixed}
+	if isNew {
+		hashes.WriteAt(root, (treeSize-1)*hashSize)
+		t.known.Set(int(treeSize - 1))
+		t.known.Sync()
+	}
+	if mixed.err != nil {
+		return nil, t.Close()
+	}
+	return t, nil
 }
 
-func (m *metaStore) GetInnerHashes(key HLKey, hs []byte, level ht.Level, off ht.Nodes) error {
-	_, _, rebased := m.asserInRange(key, hs, level, off)
-	fileBlobs, hashes, countingSet, closer := m.getHashBlob(key)
-	defer closer.Close()
-	if countingSet.Count() != int(fileBlobs) {
-		return fmt.Errorf("hash incomplete")
-	}
-	hashes.ReadAt(hs, hashSize*ht.HashPosition(fileBlobs, rebased, off))
-	return nil
+//getHashTree opens the tree of key above minLevel, the caller must hold the
+//lock of key.
+func (m *metaStore) getHashTree(key HLKey) (*hashTree, error) {
+	fileBlobs, _, _, _ := m.mixedBlobSizes(key)
+	return m.openTree(key.GetHash(), fileBlobs, key.GetHash())
 }
 
-func (m *metaStore) PutInnerHashes(key HLKey, hs []byte, level ht.Level, off ht.Nodes) (has ht.Nodes, complete bool, err error) {
-	_, lw, rebased := m.asserInRange(key, hs, level, off)
-	fileBlobs, hashes, countingSet, closer := m.getHashBlob(key)
-	defer closer.Close()
-	if countingSet.Count() == int(fileBlobs) {
-		//already done, so it's a no-op
-		return ht.Nodes(countingSet.Count()), true, nil
+//get reads the hashes at level from off, an error is returned if any of them
+//is unknown.
+func (t *hashTree) get(hs []byte, level ht.Level, off ht.Nodes) error {
+	t.hashes.ReadAt(hs, ht.HashPosition(t.width, level, off))
+	if t.mixed.err != nil {
+		return t.mixed.err
 	}
+	first := int(ht.HashNumber(t.width, level, off))
+	for i := 0; i < len(hs)/hashSize; i++ {
+		if !t.known.Get(first + i) {
+			return fmt.Errorf("hash incomplete")
+		}
+	}
+	return nil
+}
 
-	writeHash := func(rebasedL ht.Level, woff ht.Nodes, hash, left, right *ht.H256) {
-		n := int(ht.HashNumber(fileBlobs, rebasedL, woff))
-		woffBytes := int64(n * hashSize)
-		hashes.WriteAt(hash.ToBytes(), woffBytes)
-		countingSet.Set(n)
+//put saves the hashes at level from off that are verified by the known
+//hashes above them. bad is true if some don't match, hashes that can't be
+//verified yet are left out.
+func (t *hashTree) put(suite *ht.Suite, hs []byte, level ht.Level, off ht.Nodes) (bad bool, err error) {
+	n := ht.Nodes(len(hs) / hashSize)
+	lw := ht.LevelWidth(t.width, level)
+	writeHash := func(l ht.Level, woff ht.Nodes, hash *ht.H256) {
+		n := int(ht.HashNumber(t.width, l, woff))
+		t.hashes.WriteAt(hash.ToBytes(), int64(n*hashSize))
+		t.known.Set(n)
 	}
 
 	rootBuffer := make([]byte, hashSize)
-	splited := ht.SplitLocalSummable(hs, hashSize, lw, off)
-	c := ht.NewNoPadTree()
-	var sum []byte
-	for i := 0; i < len(splited); i++ {
-		s := splited[i]
-		hashHeight := ht.Levels(ht.Nodes(len(s) / hashSize))
-		rebasedRootLevel := rebased + hashHeight
-		rootOff := off >> uint(hashHeight)
-		rootPosition := int(ht.HashNumber(fileBlobs, rebasedRootLevel, rootOff))
-		if rootPosition == countingSet.Capacity() {
-			copy(rootBuffer, key.GetHash()) //root is the key
-		} else if !countingSet.Get(rootPosition) {
-			goto next //don't have the root, skiped
-		} else {
-			hashes.ReadAt(rootBuffer, int64(rootPosition)*hashSize)
+	c := ht.NewTree2(ht.NoPad32bytes, suite.Compressor)
+	for _, r := range ht.LocalSummableRanges(off, off+n-1, lw) {
+		s := hs[(r[0]-off)*hashSize : (r[1]-off+1)*hashSize]
+		hashHeight := ht.Levels(r[1]-r[0]+1) - 1
+		rootLevel := level + hashHeight
+		rootOff := r[0] >> uint(hashHeight)
+		rootPosition := int(ht.HashNumber(t.width, rootLevel, rootOff))
+		if !t.known.Get(rootPosition) {
+			continue //don't have the root, skiped
 		}
+		t.hashes.ReadAt(rootBuffer, int64(rootPosition)*hashSize)
 		c.Write(s)
-		sum = c.Sum(nil)
+		sum := c.Sum(nil)
 		c.Reset()
-		if bytes.Equal(sum, rootBuffer) {
-			//hashes verified, good for saving
-			c.SetInnerHashListener(func(l ht.Level, hoff ht.Nodes, hash, left, right *ht.H256) {
-				rebasedL := l + rebased
-				woff := hoff + rootOff<<uint32(rebasedRootLevel-l)
-				if rebasedL == rebasedRootLevel {
-					return
-				}
-				writeHash(rebasedL, woff, hash, left, right)
-				//propagate down nodes with single branch
-				for rebasedL > 0 &&
-					woff+1 == ht.LevelWidth(fileBlobs, rebasedL) &&
-					woff%2 == 0 {
-					rebasedL--
-					woff = ht.LevelWidth(fileBlobs, rebasedL) - 1
-					writeHash(rebasedL, woff, hash, left, right)
-				}
-			})
-			c.Write(s)
-			c.Sum(nil)
-			c.SetInnerHashListener(nil)
-			c.Reset()
+		if !bytes.Equal(sum, rootBuffer) {
+			bad = true
+			continue
 		}
-	next:
-		off += ht.Nodes(len(s) / hashSize)
+		//hashes verified, good for saving
+		c.SetInnerHashListener(func(l ht.Level, hoff ht.Nodes, hash, left, right *ht.H256) {
+			l += level
+			if l == rootLevel {
+				return
+			}
+			woff := hoff + rootOff<<uint(rootLevel-l)
+			writeHash(l, woff, hash)
+			//propagate down nodes with single branch
+			for l > 0 &&
+				woff+1 == ht.LevelWidth(t.width, l) &&
+				ht.LevelWidth(t.width, l-1)%2 == 1 {
+				l--
+				woff = ht.LevelWidth(t.width, l) - 1
+				writeHash(l, woff, hash)
+			}
+		})
+		c.Write(s)
+		c.Sum(nil)
+		c.SetInnerHashListener(nil)
+		c.Reset()
 	}
-	hashes.Sync()
-	countingSet.Sync()
-	return ht.Nodes(countingSet.Count()), countingSet.Full(), nil
+	if t.mixed.err != nil {
+		return false, t.mixed.err //bad may be from hashes not read
+	}
+	return bad, nil
+}
+
+//Close syncs the known hashes and the hashes in one journal commit, and
+//returns the first error of the tree.
+func (t *hashTree) Close() error {
+	t.known.Sync()
+	t.mixed.Close()
+	return t.mixed.err
+}
+
+func (m *metaStore) GetInnerHashes(key HLKey, hs []byte, level ht.Level, off ht.Nodes) (err error) {
+	_, _, rebased := m.asserInRange(key, hs, level, off)
+	m.locks.lock(key.GetHash())
+	defer m.locks.unlock(key.GetHash())
+	t, err := m.getHashTree(key)
+	if err != nil {
+		return err
+	}
+	err = t.get(hs, rebased, off)
+	if e := t.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func (m *metaStore) PutInnerHashes(key HLKey, hs []byte, level ht.Level, off ht.Nodes) (has ht.Nodes, complete bool, err error) {
+	_, _, rebased := m.asserInRange(key, hs, level, off)
+	suite, err := ht.GetSuite(key.Suite())
+	if err != nil {
+		return 0, false, err
+	}
+	m.locks.lock(key.GetHash())
+	defer m.locks.unlock(key.GetHash())
+	t, err := m.getHashTree(key)
+	if err != nil {
+		return 0, false, err
+	}
+	if !t.known.Full() {
+		_, err = t.put(suite, hs, rebased, off)
+	}
+	has, complete = ht.Nodes(t.known.Count()), t.known.Full()
+	if e := t.Close(); err == nil {
+		err = e
+	}
+	return has, complete, err
+}
+
+//hashCount returns the number of hashes known of key above minLevel.
+func (m *metaStore) hashCount(key HLKey) (has ht.Nodes, complete bool, err error) {
+	m.locks.lock(key.GetHash())
+	defer m.locks.unlock(key.GetHash())
+	t, err := m.getHashTree(key)
+	if err != nil {
+		return 0, false, err
+	}
+	has, complete = ht.Nodes(t.known.Count()), t.known.Full()
+	return has, complete, t.Close()
+}
+
+//deleteHashTree deletes the hashes of key above minLevel.
+func (m *metaStore) deleteHashTree(key HLKey) error {
+	m.locks.lock(key.GetHash())
+	defer m.locks.unlock(key.GetHash())
+	_, blobBytes, _, _ := m.mixedBlobSizes(key)
+	gone, err := m.hashStore.Delete(key.GetHash(), blobBytes)
+	if gone {
+		return nil
+	}
+	return err
 }
 
 func (m *metaStore) TTLGet(key HLKey) TTL {
@@ -158,6 +362,14 @@ func (m *metaStore) TTLGet(key HLKey) TTL {
 	return TTLFromBytes(v)
 }
 func (m *metaStore) TTLSetAtleast(key HLKey, freeFrom, until TTL) (byteMonth int64) {
+	byteMonth = m.ttlSetAtleast(key, freeFrom, until)
+	m.ttlStore.Sync()
+	return
+}
+
+//ttlSetAtleast is TTLSetAtleast without Sync, later calls will not see the
+//change before Sync.
+func (m *metaStore) ttlSetAtleast(key HLKey, freeFrom, until TTL) (byteMonth int64) {
 	old := m.TTLGet(key)
 	if old >= until {
 		return 0
@@ -174,8 +386,9 @@ func (m *metaStore) TTLSetAtleast(key HLKey, freeFrom, until TTL) (byteMonth int
 func (m *metaStore) Close() error {
 	err := m.ttlStore.Close()
 	err2 := m.hashStore.Close()
-	if err != nil || err2 != nil {
-		return fmt.Errorf("fail close meta store, ttlStore err: %v; hashStore err: %v", err, err2)
+	err3 := m.journal.Close()
+	if err != nil || err2 != nil || err3 != nil {
+		return fmt.Errorf("fail close meta store, ttlStore err: %v; hashStore err: %v; journal err: %v", err, err2, err3)
 	}
 	return nil
 }
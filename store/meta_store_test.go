@@ -1,8 +1,10 @@
 package store
 
 import (
+	"bytes"
 	"os"
 	"testing"
+	"time"
 
 	ht "github.com/xiegeo/fensan/hashtree"
 )
@@ -29,3 +31,116 @@ func testSetUp(t *testing.T) (source MetaStore, part MetaStore) {
 	part, _ = OpenMetaStore(partFolder)
 	return
 }
+
+func TestMetaStorePutGet(t *testing.T) {
+	_, m := testSetUp(t)
+	defer os.RemoveAll(".testSourceMetaStore")
+	defer os.RemoveAll(".testPartMetaStore")
+	defer m.Close()
+	testMetaStorePutGet(t, m)
+}
+
+func TestMetaStoreMem(t *testing.T) {
+	m := NewMetaStoreOn(NewMemKV(), NewMemLVE())
+	defer m.Close()
+	testMetaStorePutGet(t, m)
+	key := NewHLKey(make([]byte, hashSize), 1)
+	m.TTLSetAtleast(key, 5, 5)
+	if m.TTLGet(key) != 5 {
+		t.Error("TTL not saved")
+	}
+}
+
+func testMetaStorePutGet(t *testing.T, m MetaStore) {
+	//a made up file of 5 blobs, only hashes are needed
+	blobs := 5
+	level := m.InnerHashMinLevel()
+	hs := testData(blobs*hashSize, 3)
+	tree := ht.NewNoPadTree()
+	upper := make([]byte, 0, 3*hashSize)
+	tree.SetInnerHashListener(func(l ht.Level, i ht.Nodes, hash, left, right *ht.H256) {
+		if l == 1 {
+			upper = append(upper, hash.ToBytes()...)
+		}
+	})
+	tree.Write(hs)
+	key := NewHLKey(tree.Sum(nil), int64(blobs)*BlobSize-10)
+
+	has, complete, err := m.PutInnerHashes(key, hs[hashSize:], level, 1)
+	if err != nil || has != 1 || complete {
+		t.Fatal("unverifiable hashes saved", has, complete, err)
+	}
+	if m.GetInnerHashes(key, make([]byte, hashSize), level, 4) == nil {
+		t.Fatal("unknown hash read")
+	}
+	has, complete, err = m.PutInnerHashes(key, upper, level+1, 0)
+	if err != nil || has != 1+2+3+1 || complete {
+		t.Fatal(has, complete, err)
+	}
+	got := make([]byte, hashSize)
+	err = m.GetInnerHashes(key, got, level, 4)
+	if err != nil || !bytes.Equal(got, hs[4*hashSize:]) {
+		t.Fatal("promoted hash not saved", err)
+	}
+	has, complete, err = m.PutInnerHashes(key, hs[2*hashSize:4*hashSize], level, 2)
+	if err != nil || has != 1+2+3+3 || complete {
+		t.Fatal(has, complete, err)
+	}
+	bad := append([]byte(nil), hs[:2*hashSize]...)
+	bad[0]++
+	has, complete, err = m.PutInnerHashes(key, bad, level, 0)
+	if err != nil || has != 1+2+3+3 || complete {
+		t.Fatal("bad hashes saved", has, complete, err)
+	}
+	has, complete, err = m.PutInnerHashes(key, hs, level, 0)
+	if err != nil || has != 1+2+3+5 || !complete {
+		t.Fatal(has, complete, err)
+	}
+	got = make([]byte, len(hs))
+	err = m.GetInnerHashes(key, got, level, 0)
+	if err != nil || !bytes.Equal(got, hs) {
+		t.Fatal("hashes read back wrong", err)
+	}
+}
+
+func TestMigrateTTLEpoch(t *testing.T) {
+	now := time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC)
+	kv := NewMemKV()
+	k := NewHLKey(make([]byte, hashSize), 1).FullBytes()
+	kv.Set(k, (oldTTLOf(now) + 3).Bytes())
+	kv.Sync()
+	migrateTTLEpoch(kv, now)
+	if got := TTLFromBytes(kv.Get(k)); got != ttlOf(now)+3 {
+		t.Fatal("not migrated", got, ttlOf(now)+3)
+	}
+	if kv.Get(ttlEpochKey) == nil {
+		t.Fatal("marker not set")
+	}
+	migrateTTLEpoch(kv, now)
+	if got := TTLFromBytes(kv.Get(k)); got != ttlOf(now)+3 {
+		t.Fatal("migrated twice", got)
+	}
+}
+
+func TestMetaStoreHashLayout(t *testing.T) {
+	path := ".testMetaStoreHashLayout"
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+	m, err := openMetaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+	m, err = openMetaStore(path)
+	if err != nil {
+		t.Fatal("reopen:", err)
+	}
+	m.Close()
+
+	//a hash store from before the marker
+	os.RemoveAll(path)
+	os.MkdirAll(path+"/m_hash/00/00", 0777)
+	if _, err = openMetaStore(path); err == nil {
+		t.Fatal("old hash layout opened")
+	}
+}
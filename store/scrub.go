@@ -0,0 +1,204 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	ht "github.com/xiegeo/fensan/hashtree"
+)
+
+//ScrubStats reports what Scrub checked.
+type ScrubStats struct {
+	Files   int64 //complete files verified
+	Bytes   int64 //bytes of data read
+	Corrupt int64 //blobs that failed verification
+	Hashes  int64 //files with stored inner hashes that failed verification
+	Unread  int64 //blobs that could not be read, kept to scrub again
+}
+
+//Scrub reads and verifies every complete file. report is called for each blob
+//that failed, which may be nil.
+//
+//A failed blob is deleted, as it can be shared, and its leafs are no longer
+//verified, so the file is FilePart until it's downloaded again. Other files
+//with the same blob fail when they are scrubbed. Stored inner hashes are
+//checked too, wrong hashes above the blobs are rebuilt from the blob hashes,
+//if the blob hashes are wrong, the inner hashes are deleted and every blob of
+//the file fails. A blob that can't be read is kept and counted in Unread, not
+//as corrupt, and the file is not marked verified.
+func (d *database) Scrub(report func(key HLKey, blob ht.Nodes)) (stats ScrubStats, err error) {
+	err = d.time.check()
+	if err != nil {
+		return
+	}
+	buf := make([]byte, BlobSize)
+	err = d.stateStore.walk(func(k []byte, _ int64) error {
+		key, ok := hLKeyFromFullBytes(k)
+		if !ok {
+			return nil
+		}
+		corrupt, err := d.scrubFile(key, buf, &stats)
+		if report != nil {
+			for _, i := range corrupt {
+				report(key, i)
+			}
+		}
+		return err
+	})
+	d.verifiedStore.Sync()
+	return
+}
+
+//ScrubFile verifies a complete file like Scrub, and returns the blobs failed.
+func (d *database) ScrubFile(key HLKey) (corrupt []ht.Nodes, err error) {
+	err = d.time.check()
+	if err != nil {
+		return nil, err
+	}
+	if d.GetState(key) != FileComplete {
+		return nil, fmt.Errorf("file is not complete")
+	}
+	var stats ScrubStats
+	corrupt, err = d.scrubFile(key, make([]byte, minInt64(key.GetLength(), BlobSize)), &stats)
+	d.verifiedStore.Sync()
+	return corrupt, err
+}
+
+//LastVerified returns when a scrub last found no errors in the file, or the
+//zero time if never.
+func (d *database) LastVerified(key HLKey) time.Time {
+	v := d.verifiedStore.Get(key.FullBytes())
+	if len(v) != 8 {
+		return time.Time{}
+	}
+	return time.Unix(int64(binary.LittleEndian.Uint64(v)), 0)
+}
+
+//scrubFile verifies key if it's complete, buf must hold a blob of it.
+func (d *database) scrubFile(key HLKey, buf []byte, stats *ScrubStats) (corrupt []ht.Nodes, err error) {
+	d.fileLocks.lock(key.FullBytes())
+	defer d.fileLocks.unlock(key.FullBytes())
+	s, err := d.openState(key, false)
+	if s == nil || err != nil {
+		return nil, err
+	}
+	defer func() {
+		if e := s.Close(); err == nil {
+			err = e
+		}
+	}()
+	if !s.have.Full() {
+		return nil, nil
+	}
+	suite, err := ht.GetSuite(key.Suite())
+	if err != nil {
+		return nil, err
+	}
+	length := key.GetLength()
+	blobs := ht.Nodes((length + BlobSize - 1) / BlobSize)
+	hashes, ok, err := d.scrubHashes(key, suite, stats)
+	if err != nil {
+		return nil, err
+	}
+	unread := 0
+	for i := ht.Nodes(0); i < blobs; i++ {
+		fromLeaf, toLeaf, _, size := blobRange(length, i)
+		if ok {
+			good, err := d.scrubBlob(suite, hashes[int64(i)*hashSize:int64(i+1)*hashSize], buf[:size], stats)
+			if err != nil {
+				unread++
+				continue
+			}
+			if good {
+				continue
+			}
+		}
+		for l := fromLeaf; l < toLeaf; l++ {
+			s.have.Unset(int(l))
+		}
+		corrupt = append(corrupt, i)
+	}
+	if length == 0 && !bytes.Equal(suite.NewFile().Sum(nil), key.GetHash()) {
+		s.have.Unset(0)
+		corrupt = append(corrupt, 0)
+	}
+	stats.Files++
+	stats.Corrupt += int64(len(corrupt))
+	stats.Unread += int64(unread)
+	if len(corrupt) == 0 && unread == 0 {
+		var v [8]byte
+		binary.LittleEndian.PutUint64(v[:], uint64(time.Now().Unix()))
+		d.verifiedStore.Set(key.FullBytes(), v[:])
+	}
+	return corrupt, nil
+}
+
+//scrubBlob reads and verifies the blob with hash, the blob is deleted if it's
+//wrong, and kept if it can't be read.
+func (d *database) scrubBlob(suite *ht.Suite, hash []byte, buf []byte, stats *ScrubStats) (bool, error) {
+	found, ok, err := d.checkBlob(suite, hash, buf)
+	if found && err == nil {
+		stats.Bytes += int64(len(buf))
+	}
+	return ok, err
+}
+
+//scrubHashes returns the blob hashes of key, after checking them and the
+//stored inner hashes above them against the root. ok is false if the blob
+//hashes are wrong, err is from deleting or rebuilding them.
+func (d *database) scrubHashes(key HLKey, suite *ht.Suite, stats *ScrubStats) (hashes []byte, ok bool, err error) {
+	length := key.GetLength()
+	if length <= BlobSize {
+		return key.GetHash(), true, nil
+	}
+	leafs := ht.I.Nodes(length)
+	hashes = make([]byte, int64(ht.LevelWidth(leafs, d.minLevel))*hashSize)
+	err = d.GetInnerHashes(key, hashes, d.minLevel, 0)
+	nodes := make([]ht.H256, len(hashes)/hashSize)
+	for i := range nodes {
+		nodes[i] = *ht.FromBytes(hashes[i*hashSize:])
+	}
+	rebuild := false
+	for level := d.minLevel + 1; len(nodes) > 1; level++ {
+		n := len(nodes) / 2
+		for i := 0; i < n; i++ {
+			nodes[i] = *suite.Compressor(&nodes[i*2], &nodes[i*2+1])
+		}
+		if len(nodes)%2 == 1 {
+			nodes[n] = nodes[len(nodes)-1]
+			n++
+		}
+		nodes = nodes[:n]
+		if n == 1 || rebuild {
+			continue
+		}
+		stored := make([]byte, n*hashSize)
+		if d.GetInnerHashes(key, stored, level, 0) != nil {
+			rebuild = true
+			continue
+		}
+		for i := range nodes {
+			if !bytes.Equal(stored[i*hashSize:(i+1)*hashSize], nodes[i].ToBytes()) {
+				rebuild = true
+				break
+			}
+		}
+	}
+	if err != nil || !bytes.Equal(nodes[0].ToBytes(), key.GetHash()) {
+		stats.Hashes++
+		return nil, false, d.deleteHashTree(key)
+	}
+	if rebuild {
+		stats.Hashes++
+		err = d.deleteHashTree(key)
+		if err == nil {
+			_, _, err = d.metaStore.PutInnerHashes(key, hashes, d.minLevel, 0)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return hashes, true, nil
+}
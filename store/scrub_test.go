@@ -0,0 +1,137 @@
+package store
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	ht "github.com/xiegeo/fensan/hashtree"
+)
+
+func TestScrub(t *testing.T) {
+	path := ".testScrub"
+	db := openTestDatabase(t, path)
+	defer os.RemoveAll(path)
+	defer db.Close()
+	d := db.(*database)
+
+	data := testData(BlobSize*2+5000, 5)
+	key, err := db.ImportFromReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, err := db.ImportFromReader(bytes.NewReader(data[:100]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.TTLSetAtleast(key, TTLNow(), TTLNow()+12) //small is scrubbed without one
+	_, blobHashes := testKey(t, data)
+
+	var failed []ht.Nodes
+	report := func(k HLKey, blob ht.Nodes) {
+		if !bytes.Equal(k.FullBytes(), key.FullBytes()) {
+			t.Errorf("blob %v of an other file failed", blob)
+		}
+		failed = append(failed, blob)
+	}
+	stats, err := db.Scrub(report)
+	if err != nil || stats.Files != 2 || stats.Corrupt != 0 || stats.Bytes != int64(len(data))+100 {
+		t.Fatalf("%+v %v", stats, err)
+	}
+	if db.LastVerified(key).IsZero() || db.LastVerified(small).IsZero() {
+		t.Fatal("verified time not saved")
+	}
+
+	//bad data
+	blob, _ := d.dataStore.Get(blobKey(key.Suite(), blobHashes[hashSize:2*hashSize], BlobSize), BlobSize)
+	blob.WriteAt([]byte{1}, 100)
+	blob.Close()
+	stats, err = db.Scrub(report)
+	if err != nil || stats.Corrupt != 1 || len(failed) != 1 || failed[0] != 1 {
+		t.Fatalf("%+v %v %v", stats, failed, err)
+	}
+	if db.GetState(key) != FilePart {
+		t.Fatal("corrupt file is still complete")
+	}
+	_, complete, err := db.PutAt(key, data[BlobSize:2*BlobSize], BlobSize)
+	if err != nil || !complete {
+		t.Fatal("can't download the blob again", err)
+	}
+
+	//bad inner hashes above blobs
+	fileBlobs, blobBytes, _, _ := d.mixedBlobSizes(key)
+	hashBlob, _ := d.hashStore.Get(key.GetHash(), blobBytes)
+	hashBlob.WriteAt([]byte{1}, ht.HashNumber(fileBlobs, 1, 0)*hashSize)
+	hashBlob.Close()
+	corrupt, err := db.ScrubFile(key)
+	if err != nil || len(corrupt) != 0 {
+		t.Fatal(corrupt, err)
+	}
+	got := make([]byte, 2*hashSize)
+	err = db.GetInnerHashes(key, got, d.minLevel+1, 0)
+	tree := ht.NewNoPadTree()
+	var upper []byte
+	tree.SetInnerHashListener(func(l ht.Level, i ht.Nodes, hash, left, right *ht.H256) {
+		if l == 1 {
+			upper = append(upper, hash.ToBytes()...)
+		}
+	})
+	tree.Write(blobHashes)
+	tree.Sum(nil)
+	if err != nil || !bytes.Equal(got, upper) {
+		t.Fatal("inner hashes not rebuilt", err)
+	}
+
+	//bad blob hashes
+	hashBlob, _ = d.hashStore.Get(key.GetHash(), blobBytes)
+	hashBlob.WriteAt([]byte{1}, 0)
+	hashBlob.Close()
+	corrupt, err = db.ScrubFile(key)
+	if err != nil || len(corrupt) != 3 {
+		t.Fatal(corrupt, err)
+	}
+	if db.GetState(key) != FilePart {
+		t.Fatal("file without hashes is still complete")
+	}
+	_, complete, err = db.PutInnerHashes(key, blobHashes, d.minLevel, 0)
+	if err != nil || !complete {
+		t.Fatal("can't put hashes again", err)
+	}
+	_, complete, err = db.PutAt(key, data, 0)
+	if err != nil || !complete {
+		t.Fatal("can't complete again", err)
+	}
+	corrupt, err = db.ScrubFile(key)
+	if err != nil || len(corrupt) != 0 {
+		t.Fatal(corrupt, err)
+	}
+}
+
+func TestScrubReadError(t *testing.T) {
+	path := ".testScrubReadError"
+	db := openTestDatabase(t, path)
+	defer os.RemoveAll(path)
+	defer db.Close()
+	d := db.(*database)
+
+	data := testData(100, 5)
+	key, err := db.ImportFromReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lv := d.dataStore
+	d.dataStore = failingLV{lv, blobKey(key.Suite(), key.GetHash(), 100)}
+	stats, err := db.Scrub(nil)
+	if err != nil || stats.Unread != 1 || stats.Corrupt != 0 {
+		t.Fatalf("%+v %v", stats, err)
+	}
+	if db.GetState(key) != FileComplete || !db.LastVerified(key).IsZero() {
+		t.Fatal("unread blob failed or verified")
+	}
+	d.dataStore = lv
+	got := make([]byte, len(data))
+	err = db.GetAt(key, got, 0)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatal("unread blob deleted", err)
+	}
+}
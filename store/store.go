@@ -23,6 +23,7 @@ package store
 import (
 	"io"
 	"os"
+	"time"
 
 	"github.com/xiegeo/fensan/bitset"
 	ht "github.com/xiegeo/fensan/hashtree"
@@ -45,6 +46,12 @@ type KV interface {
 	Sync()
 	//Close closes KV.
 	Close() error
+	//GC calls f on each key and value in order of keys, starting after
+	//startAfterKey, or from the first key if startAfterKey is nil. The key
+	//is deleted if f returns delete, and GC returns after f returns stop.
+	//
+	//GC can run at the same time as other calls, keys Set after GC started
+	//might or might not be seen by f.
 	GC(startAfterKey []byte, f func(key []byte, v []byte) (delete bool, stop bool))
 }
 
@@ -69,6 +76,46 @@ type LV interface {
 	Close() error
 }
 
+//LVE is like LV, but I/O errors are returned instead of panicking, including
+//from its blobs. A LV is a LVE wrapped by MustLV.
+type LVE interface {
+	//New creates a new block in LV, or nil if the key already exist.
+	//size > 0
+	New(key []byte, size int64) (BlobE, error)
+	//Get returns the Block referenced by key, or nil if key is not found.
+	Get(key []byte, size int64) (BlobE, error)
+	Move(oldKey []byte, oldSize int64, newKey []byte, newSize int64) error
+	Delete(key []byte, size int64) (bool, error)
+	Close() error
+}
+
+//MustLV turns a LVE to a LV that panics on errors.
+func MustLV(lv LVE) LV {
+	return mustLV{lv}
+}
+
+type mustLV struct {
+	LVE
+}
+
+func (m mustLV) New(key []byte, size int64) Blob {
+	return mustBlob(m.LVE.New(key, size))
+}
+
+func (m mustLV) Get(key []byte, size int64) Blob {
+	return mustBlob(m.LVE.Get(key, size))
+}
+
+func mustBlob(b BlobE, err error) Blob {
+	if err != nil {
+		panic(err)
+	}
+	if b == nil {
+		return nil
+	}
+	return bitset.MustBlob(b)
+}
+
 type FileState int
 
 const (
@@ -87,6 +134,11 @@ type Blob interface {
 	bitset.Blob
 }
 
+//staticly import BlobE interface from bitset
+type BlobE interface {
+	bitset.BlobE
+}
+
 //staticly import NewBlobFromFile function from bitset
 func NewBlobFromFile(file *os.File, size int64) Blob {
 	return bitset.NewBlobFromFile(file, size)
@@ -126,8 +178,7 @@ type MetaStore interface {
 	Close() error
 }
 
-//Database is the full interface for all the data of a server,
-//WIP
+//Database is the full interface for all the data of a server.
 type Database interface {
 	MetaStore
 	//GetState checks if we have a file or not, or in progress
@@ -144,8 +195,25 @@ type Database interface {
 	//to demote the source.
 	PutAt(key HLKey, b []byte, off int64) (has ht.Nodes, complete bool, err error)
 
-	//Import a file from reader
-	ImportFromReader(r io.Reader) HLKey
+	//ImportFromReader imports a file from reader, and returns it's key.
+	ImportFromReader(r io.Reader) (HLKey, error)
+
+	//ReadOnly reports if time skipped forward too much, then writes and
+	//deletions are refused with ErrReadOnly, but TTL can still be updated.
+	ReadOnly() bool
+	//ConfirmTime accepts the current time as correct, and ends read only.
+	//Give clients a chance to update TTL before calling it.
+	ConfirmTime() error
+
+	//Scrub reads and verifies all complete files, with or without TTL, so
+	//that TTL extensions can go along with full read verification. Blobs that
+	//fail are reported, and the files turn to FilePart.
+	Scrub(report func(key HLKey, blob ht.Nodes)) (ScrubStats, error)
+	//ScrubFile verifies a complete file like Scrub, and returns the blobs failed.
+	ScrubFile(key HLKey) (corrupt []ht.Nodes, err error)
+	//LastVerified returns when a scrub last found no errors in the file, or
+	//the zero time if never.
+	LastVerified(key HLKey) time.Time
 }
 
 type metaValue struct {
@@ -0,0 +1,103 @@
+package store
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+//ErrReadOnly is returned for writes and deletes after the time skipped forward
+//more than allowed, until ConfirmTime is called.
+var ErrReadOnly = errors.New("store: read only after a time skip, confirm the time to resume")
+
+//DefaultMaxTimeSkip is the most months TTLNow can move forward at once,
+//before the store turns read only.
+const DefaultMaxTimeSkip = 3
+
+const timeGuardFile = "/last_ttl"
+
+//timeGuard protects from mass deletions when time skips forward, by a
+//misconfigured clock, or a long power off. The last TTLNow seen is saved, if
+//it moves forward by more than maxSkip, the store is read only until the time
+//is confirmed.
+type timeGuard struct {
+	mu       sync.Mutex
+	now      func() TTL //the clock, TTLNow except in tests
+	file     string
+	maxSkip  TTL
+	last     TTL
+	readOnly bool
+}
+
+func openTimeGuard(path string, maxSkip int16, now func() TTL) (*timeGuard, error) {
+	g := &timeGuard{now: now, file: path + timeGuardFile, maxSkip: TTL(maxSkip)}
+	b, err := ioutil.ReadFile(g.file)
+	if os.IsNotExist(err) {
+		//new store
+		g.last = now()
+		return g, g.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 2 {
+		return nil, errors.New("store: bad " + g.file)
+	}
+	g.last = TTLFromBytes(b)
+	if g.last < 0 {
+		//saved by the old oldTTLOf epoch, no months before 2000 are used
+		g.last = now()
+		return g, g.save()
+	}
+	return g, g.check()
+}
+
+func (g *timeGuard) save() error {
+	err := ioutil.WriteFile(g.file+".new", g.last.Bytes(), 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(g.file+".new", g.file)
+}
+
+//check returns ErrReadOnly if time skipped, else saves the time if it moved
+//forward. Time moving backward is ignored, as it can't cause deletions.
+func (g *timeGuard) check() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.readOnly {
+		return ErrReadOnly
+	}
+	now := g.now()
+	if now <= g.last {
+		return nil
+	}
+	if now-g.last > g.maxSkip {
+		g.readOnly = true
+		return ErrReadOnly
+	}
+	g.last = now
+	return g.save()
+}
+
+//confirm accepts the current time, and ends read only.
+func (g *timeGuard) confirm() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.last = g.now()
+	err := g.save()
+	if err != nil {
+		return err
+	}
+	g.readOnly = false
+	return nil
+}
+
+func (d *database) ReadOnly() bool {
+	return d.time.check() == ErrReadOnly
+}
+
+func (d *database) ConfirmTime() error {
+	return d.time.confirm()
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+//testClock is a clock for timeGuard, set by tests.
+type testClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *testClock) set(t time.Time) {
+	c.mu.Lock()
+	c.t = t
+	c.mu.Unlock()
+}
+
+func (c *testClock) now() TTL {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ttlOf(c.t)
+}
+
+func TestTimeSkip(t *testing.T) {
+	path := ".testTimeSkip"
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+	start := time.Date(2020, time.March, 10, 0, 0, 0, 0, time.UTC)
+	clock := &testClock{t: start}
+
+	db, err := openDatabase(path, 2, clock.now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.set(start.AddDate(0, 2, 0))
+	if db.ReadOnly() {
+		t.Fatal("2 months is allowed")
+	}
+	db.Close()
+
+	//skip on open
+	clock.set(start.AddDate(0, 5, 0))
+	db, err = openDatabase(path, 2, clock.now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !db.ReadOnly() {
+		t.Fatal("skip on open not found")
+	}
+	c, _ := NewCollector(db)
+	_, err = db.ImportFromReader(bytes.NewReader([]byte{1}))
+	if err != ErrReadOnly {
+		t.Fatal("import while read only:", err)
+	}
+	_, err = c.Step(10)
+	if err != ErrReadOnly {
+		t.Fatal("collect while read only:", err)
+	}
+	err = db.ConfirmTime()
+	if err != nil || db.ReadOnly() {
+		t.Fatal("confirm failed", err)
+	}
+	key, err := db.ImportFromReader(bytes.NewReader([]byte{1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//skip while running
+	clock.set(start.AddDate(1, 0, 0))
+	_, _, err = db.PutAt(key, []byte{1}, 0)
+	if err != ErrReadOnly {
+		t.Fatal("put while read only:", err)
+	}
+	clock.set(start.AddDate(0, 5, 0))
+	if !db.ReadOnly() {
+		t.Fatal("read only must stay until confirmed")
+	}
+	db.Close()
+}
+
+func TestTimeGuardOldEpoch(t *testing.T) {
+	path := ".testTimeGuardOldEpoch"
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+	os.MkdirAll(path, 0777)
+	clock := &testClock{t: time.Date(2020, time.March, 10, 0, 0, 0, 0, time.UTC)}
+	err := ioutil.WriteFile(path+timeGuardFile, oldTTLOf(clock.t).Bytes(), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := openTimeGuard(path, 2, clock.now)
+	if err != nil || g.readOnly || g.last != clock.now() {
+		t.Fatal("old epoch not reset", err, g.last)
+	}
+}
@@ -1,6 +1,9 @@
 package store
 
-import "time"
+import (
+	"sync/atomic"
+	"time"
+)
 
 const ttl_base_year = 2000
 
@@ -14,25 +17,30 @@ const (
 	TTLLongAgo = TTL(-1)
 )
 
-var ttl_now = int16(0)
+var ttl_now int32 //cached TTLNow, 0 if not cached, used atomically
 
 //Return a TTL for the current period (month), cached. This is a TTL of 0.
 //
 func TTLNow() TTL {
-	cached := TTL(ttl_now)
+	cached := TTL(atomic.LoadInt32(&ttl_now))
 	if cached == 0 {
-		y, m, _ := time.Now().UTC().Date()
-		tn := int16(y - ttl_base_year*12 + (int(m) - 1))
-		ttl_now = tn
+		tn := ttlOf(time.Now())
+		atomic.StoreInt32(&ttl_now, int32(tn))
 		go func() {
 			time.Sleep(time.Second)
-			ttl_now = 0
+			atomic.StoreInt32(&ttl_now, 0)
 		}()
-		return TTL(tn)
+		return tn
 	}
 	return cached
 }
 
+//ttlOf returns the TTL of the month of t.
+func ttlOf(t time.Time) TTL {
+	y, m, _ := t.UTC().Date()
+	return TTL((y-ttl_base_year)*12 + (int(m) - 1))
+}
+
 func TTLFromBytes(b []byte) TTL {
 	return TTL(int16(b[0]) + int16(b[1])<<8)
 }